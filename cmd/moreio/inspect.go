@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/bitantics/moreio/stream"
+)
+
+// frameStats totals the frames of one type
+type frameStats struct {
+	frames  int
+	length  int64 // of the encoded payloads
+	decoded int64 // of the chunks held by data frames
+}
+
+// stat lists the frames of a stream, followed by totals for each type
+func stat(env *env, args []string) error {
+	fs := newFlagSet(env, "stat", "[file]")
+	summary := fs.Bool("summary", false, "only print totals, not every frame")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, err := open(env, fs)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tw := tabwriter.NewWriter(env.stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer tw.Flush()
+
+	fr := stream.NewFrameReader(r)
+	stats := make(map[stream.FrameType]*frameStats)
+	for index := 0; ; index++ {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			printTotals(tw, stats)
+			return err
+		}
+		if index == 0 {
+			fmt.Fprintf(tw, "chunk size\t%d\t\n\n", fr.Size())
+			if !*summary {
+				fmt.Fprintln(tw, "frame\toffset\ttype\tflags\tlength\tdecoded\t")
+			}
+		}
+
+		s := stats[f.Type]
+		if s == nil {
+			s = new(frameStats)
+			stats[f.Type] = s
+		}
+		s.frames++
+		s.length += int64(len(f.Payload))
+
+		decoded := "-"
+		if f.Type == stream.FrameData {
+			chunk, err := fr.Data(f)
+			if err != nil {
+				printTotals(tw, stats)
+				return err
+			}
+			s.decoded += int64(len(chunk))
+			decoded = fmt.Sprint(len(chunk))
+		}
+		if !*summary {
+			fmt.Fprintf(tw, "%d\t%d\t%v\t%#x\t%d\t%s\t\n",
+				index, fr.Offset(), f.Type, f.Flags, len(f.Payload), decoded)
+		}
+
+		// Indexed streams are followed by a footer, which isn't a frame
+		if f.Type == stream.FrameEnd || f.Type == stream.FrameError {
+			printTotals(tw, stats)
+			return nil
+		}
+	}
+}
+
+// printTotals of each frame type, and of the data
+func printTotals(w io.Writer, stats map[stream.FrameType]*frameStats) {
+	if len(stats) == 0 {
+		return
+	}
+	types := make([]stream.FrameType, 0, len(stats))
+	for t := range stats {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	fmt.Fprintln(w, "\ntype\tframes\tlength\t")
+	for _, t := range types {
+		fmt.Fprintf(w, "%v\t%d\t%d\t\n", t, stats[t].frames, stats[t].length)
+	}
+	if data := stats[stream.FrameData]; data != nil && data.decoded > 0 {
+		fmt.Fprintf(w, "\ndecoded\t%d\t\n", data.decoded)
+		fmt.Fprintf(w, "ratio\t%.3f\t\n", float64(data.length)/float64(data.decoded))
+	}
+}
+
+// verify decodes a whole stream, checking its checksums, trailer and
+// terminator, and prints its length and trailer
+func verify(env *env, args []string) error {
+	fs := newFlagSet(env, "verify", "[file]")
+	var req requirements
+	req.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, err := open(env, fs)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	d := stream.NewDecoder(r, req.options()...)
+	n, err := d.WriteTo(io.Discard)
+	if err != nil {
+		return fmt.Errorf("after %d bytes: %w", n, err)
+	}
+
+	fmt.Fprintf(env.stdout, "ok: %d bytes\n", n)
+	if t := d.Trailer(); t != nil {
+		fmt.Fprintf(env.stdout, "sha256: %x\n", t.SHA256)
+		keys := make([]string, 0, len(t.Fields))
+		for k := range t.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(env.stdout, "%s: %s\n", k, t.Fields[k])
+		}
+	}
+	return nil
+}
+
+// salvage decodes as much of a damaged stream as can be read, up to the
+// first chunk which can't be. Every chunk written out was verified, if the
+// stream has checksums.
+func salvage(env *env, args []string) error {
+	fs := newFlagSet(env, "salvage", "[file]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, err := open(env, fs)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := stream.NewDecoder(r).WriteTo(env.stdout)
+	if err != nil {
+		return fmt.Errorf("salvaged %d bytes: %w", n, err)
+	}
+	return nil
+}
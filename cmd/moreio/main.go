@@ -0,0 +1,238 @@
+/*
+moreio encodes, decodes and inspects streams of the stream package.
+
+Usage:
+
+	moreio encode [flags] < data > stream
+	moreio decode [flags] < stream > data
+	moreio stat [flags] [file]
+	moreio verify [flags] [file]
+	moreio salvage [file] > data
+
+Commands reading a stream take it from stdin if no file is given, or the
+file is "-". Run a command with -h for its flags.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bitantics/moreio/stream"
+)
+
+// Exit statuses
+const (
+	exitOK     = 0
+	exitFailed = 1 // the stream couldn't be read or written
+	exitUsage  = 2
+)
+
+// command of the tool, run with its arguments
+type command struct {
+	name    string
+	summary string
+	run     func(env *env, args []string) error
+}
+
+var commands = []command{
+	{"encode", "encode stdin into a stream on stdout", encode},
+	{"decode", "decode a stream on stdin to stdout", decode},
+	{"stat", "list the frames of a stream, with statistics", stat},
+	{"verify", "check a stream's checksums, trailer and terminator", verify},
+	{"salvage", "decode the readable prefix of a damaged stream", salvage},
+}
+
+// env of a command: its standard streams
+type env struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+// errUsage reports bad arguments, whose usage was already printed
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], &env{os.Stdin, os.Stdout, os.Stderr}))
+}
+
+// run the command named by the first argument, returning the exit status
+func run(args []string, env *env) int {
+	if len(args) == 0 {
+		usage(env.stderr)
+		return exitUsage
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		switch err := cmd.run(env, args[1:]); {
+		case err == nil:
+			return exitOK
+		case err == errUsage || err == flag.ErrHelp:
+			return exitUsage
+		default:
+			fmt.Fprintf(env.stderr, "moreio %s: %v\n", cmd.name, err)
+			return exitFailed
+		}
+	}
+	usage(env.stderr)
+	return exitUsage
+}
+
+// usage of the tool as a whole
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: moreio <command> [flags] [file]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// newFlagSet for the named command, taking the given arguments
+func newFlagSet(env *env, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: moreio %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// requirements are the Decoder options shared by commands reading a stream
+type requirements struct {
+	checksum    bool
+	trailer     bool
+	concurrency int
+}
+
+// register the requirements' flags
+func (r *requirements) register(fs *flag.FlagSet) {
+	fs.BoolVar(&r.checksum, "checksum", false, "require chunk checksums")
+	fs.BoolVar(&r.trailer, "trailer", false, "require a trailer")
+	fs.IntVar(&r.concurrency, "concurrency", 1, "decompress up to this many chunks at once")
+}
+
+// options to give a Decoder
+func (r *requirements) options() []stream.Option {
+	opts := []stream.Option{stream.WithConcurrency(r.concurrency)}
+	if r.checksum {
+		opts = append(opts, stream.WithChecksum())
+	}
+	if r.trailer {
+		opts = append(opts, stream.WithTrailer())
+	}
+	return opts
+}
+
+// fields are trailer fields given as repeated key=value flags
+type fields map[string]string
+
+func (f fields) String() string {
+	var kvs []string
+	for k, v := range f {
+		kvs = append(kvs, k+"="+v)
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (f fields) Set(kv string) error {
+	k, v, ok := strings.Cut(kv, "=")
+	if !ok || k == "" {
+		return errors.New("field must be key=value")
+	}
+	f[k] = v
+	return nil
+}
+
+// encode stdin into a stream on stdout
+func encode(env *env, args []string) error {
+	fs := newFlagSet(env, "encode", "")
+	size := fs.Int("size", 64<<10, "chunk size in bytes")
+	checksum := fs.Bool("checksum", false, "append a CRC-32C checksum to every chunk")
+	codec := fs.String("compress", "", "compress chunks with the named codec: flate or gzip")
+	trailer := fs.Bool("trailer", false, "end the stream with a trailer holding its length and SHA-256 digest")
+	index := fs.Bool("index", false, "append an index of all chunks, for random access")
+	sequence := fs.Bool("sequence", false, "number every chunk")
+	concurrency := fs.Int("concurrency", 1, "compress up to this many chunks at once")
+	fieldFlags := make(fields)
+	fs.Var(fieldFlags, "field", "set a trailer field, as key=value (repeatable, implies -trailer)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *size <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	opts := []stream.Option{stream.WithConcurrency(*concurrency)}
+	switch *codec {
+	case "":
+	case "flate":
+		opts = append(opts, stream.WithCompression(stream.Flate))
+	case "gzip":
+		opts = append(opts, stream.WithCompression(stream.Gzip))
+	default:
+		fmt.Fprintf(env.stderr, "unknown codec %q\n", *codec)
+		return errUsage
+	}
+	if *checksum {
+		opts = append(opts, stream.WithChecksum())
+	}
+	if *trailer || len(fieldFlags) > 0 {
+		opts = append(opts, stream.WithTrailer())
+	}
+	if *index {
+		opts = append(opts, stream.WithIndex())
+	}
+	if *sequence {
+		opts = append(opts, stream.WithSequence())
+	}
+
+	e := stream.NewEncoder(env.stdout, *size, opts...)
+	for k, v := range fieldFlags {
+		if err := e.SetTrailer(k, v); err != nil {
+			return err
+		}
+	}
+	if _, err := e.ReadFrom(env.stdin); err != nil {
+		e.CloseWithError(err)
+		return err
+	}
+	return e.Close()
+}
+
+// decode a stream on stdin to stdout
+func decode(env *env, args []string) error {
+	fs := newFlagSet(env, "decode", "")
+	var req requirements
+	req.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	_, err := stream.NewDecoder(env.stdin, req.options()...).WriteTo(env.stdout)
+	return err
+}
+
+// open the stream named by a command's arguments, or stdin
+func open(env *env, fs *flag.FlagSet) (io.ReadCloser, error) {
+	switch {
+	case fs.NArg() > 1:
+		fs.Usage()
+		return nil, errUsage
+	case fs.NArg() == 0 || fs.Arg(0) == "-":
+		return io.NopCloser(env.stdin), nil
+	default:
+		return os.Open(fs.Arg(0))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+// runWith the given stdin, returning the exit status, stdout and stderr
+func runWith(stdin []byte, args ...string) (int, []byte, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, &env{bytes.NewReader(stdin), &stdout, &stderr})
+	return status, stdout.Bytes(), stderr.String()
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestCommands(t *testing.T) {
+	Convey("Given data encoded with checksums, compression and a trailer", t, func() {
+		in := append(randomBytes(2500), bytes.Repeat([]byte("moreio"), 500)...)
+		status, enc, _ := runWith(in, "encode", "-size", "1000", "-checksum", "-compress", "flate", "-field", "name=test")
+		So(status, ShouldEqual, exitOK)
+
+		Convey("Then it should decode", func() {
+			status, out, _ := runWith(enc, "decode", "-checksum", "-trailer")
+			So(status, ShouldEqual, exitOK)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then its frames should be listed", func() {
+			status, out, _ := runWith(enc, "stat")
+			So(status, ShouldEqual, exitOK)
+			lines := strings.Split(string(out), "\n")
+			So(lines[0], ShouldContainSubstring, "1000")
+			So(string(out), ShouldContainSubstring, "trailer")
+			data := 0
+			for _, l := range lines {
+				if fields := strings.Fields(l); len(fields) == 6 && fields[2] == "data" {
+					data++
+				}
+			}
+			So(data, ShouldEqual, 6)
+			So(string(out), ShouldContainSubstring, "decoded")
+		})
+
+		Convey("Then it should verify", func() {
+			status, out, _ := runWith(enc, "verify", "-trailer")
+			So(status, ShouldEqual, exitOK)
+			So(string(out), ShouldContainSubstring, "ok: 5500 bytes")
+			So(string(out), ShouldContainSubstring, "name: test")
+		})
+
+		Convey("When it is corrupted", func() {
+			enc[len(enc)/2] ^= 1
+
+			Convey("Then it should fail to verify", func() {
+				status, _, stderr := runWith(enc, "verify")
+				So(status, ShouldEqual, exitFailed)
+				So(stderr, ShouldContainSubstring, "corrupt frame")
+			})
+
+			Convey("Then the chunks before the corruption should be salvaged", func() {
+				status, out, stderr := runWith(enc, "salvage")
+				So(status, ShouldEqual, exitFailed)
+				So(stderr, ShouldContainSubstring, "salvaged")
+				So(len(out), ShouldBeGreaterThan, 0)
+				So(len(out)%1000, ShouldEqual, 0)
+				So(out, ShouldResemble, in[:len(out)])
+			})
+		})
+
+		Convey("When it is truncated", func() {
+			enc = enc[:len(enc)*3/4]
+
+			Convey("Then it should fail to verify", func() {
+				status, _, stderr := runWith(enc, "verify")
+				So(status, ShouldEqual, exitFailed)
+				So(stderr, ShouldContainSubstring, "unexpected EOF")
+			})
+
+			Convey("Then its frames should be listed up to the truncation", func() {
+				status, out, stderr := runWith(enc, "stat", "-summary")
+				So(status, ShouldEqual, exitFailed)
+				So(string(out), ShouldContainSubstring, "data")
+				So(stderr, ShouldContainSubstring, "unexpected EOF")
+			})
+		})
+	})
+
+	Convey("Given bad arguments", t, func() {
+		Convey("Then usage should be printed", func() {
+			status, _, stderr := runWith(nil, "frobnicate")
+			So(status, ShouldEqual, exitUsage)
+			So(stderr, ShouldContainSubstring, "usage")
+
+			status, _, _ = runWith(nil, "encode", "-compress", "lzma")
+			So(status, ShouldEqual, exitUsage)
+
+			status, _, _ = runWith(nil)
+			So(status, ShouldEqual, exitUsage)
+		})
+	})
+}
@@ -0,0 +1,458 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxChunkLine is the longest chunk size line, with extensions, or trailer
+// field a ChunkedDecoder accepts
+const maxChunkLine = 4096
+
+// maxTrailerFields and maxTrailerSize bound the trailer section a
+// ChunkedDecoder accepts, in fields and in bytes
+const (
+	maxTrailerFields = 64
+	maxTrailerSize   = 16 * maxChunkLine
+)
+
+var (
+	ErrMalformedChunk = errors.New("malformed chunked encoding")
+	ErrInvalidField   = errors.New("invalid chunk extension or trailer field")
+	ErrInvalidSize    = errors.New("chunk size must be positive")
+)
+
+// ChunkExtension is a name and optional value following the size of a chunk
+// in HTTP/1.1 chunked transfer coding
+type ChunkExtension struct {
+	Name  string
+	Value string
+}
+
+// ChunkedEncoder encodes a stream with HTTP/1.1 chunked transfer coding, as
+// specified by RFC 9112. Unlike an Encoder, its output is understood by any
+// HTTP/1.1 peer, but has no header, checksums or any other features.
+type ChunkedEncoder struct {
+	w       io.Writer
+	size    int
+	ch      bytes.Buffer
+	buf     []byte
+	trailer textproto.MIMEHeader
+	err     error
+	closed  bool
+}
+
+// NewChunkedEncoder given a stream to write chunks to, and the size of the
+// chunks written when data is buffered
+func NewChunkedEncoder(s io.Writer, size int) *ChunkedEncoder {
+	ce := &ChunkedEncoder{w: s, size: size}
+	if size <= 0 {
+		ce.err = ErrInvalidSize
+	}
+	return ce
+}
+
+// Write data into the ChunkedEncoder. Written data won't be flushed to the
+// stream until enough is present to encode a chunk, or Flush is called.
+func (ce *ChunkedEncoder) Write(p []byte) (n int, err error) {
+	if err = ce.usable(); err != nil {
+		return
+	}
+	n, _ = ce.ch.Write(p)
+
+	for ce.ch.Len() >= ce.size {
+		if err = ce.writeChunk(ce.ch.Next(ce.size), nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WriteChunk writes any buffered data, followed by p as a single chunk with
+// the given extensions. Extension names must be tokens, and values are
+// quoted if necessary, but can't hold control characters other than tabs.
+func (ce *ChunkedEncoder) WriteChunk(p []byte, exts ...ChunkExtension) error {
+	if err := ce.usable(); err != nil {
+		return err
+	}
+	for _, ext := range exts {
+		if !isToken(ext.Name) || !isFieldText(ext.Value) {
+			return ErrInvalidField
+		}
+	}
+
+	if err := ce.flush(); err != nil {
+		return err
+	}
+	if len(p) == 0 {
+		// An empty chunk would end the stream
+		return nil
+	}
+	return ce.writeChunk(p, exts)
+}
+
+// Flush any buffered data to the stream as a partial chunk, without ending
+// the stream
+func (ce *ChunkedEncoder) Flush() error {
+	if err := ce.usable(); err != nil {
+		return err
+	}
+	return ce.flush()
+}
+
+// SetTrailer adds a trailer field, written after the last chunk when the
+// ChunkedEncoder is closed
+func (ce *ChunkedEncoder) SetTrailer(key, value string) error {
+	if err := ce.usable(); err != nil {
+		return err
+	}
+	if !isToken(key) || !isFieldText(value) {
+		return ErrInvalidField
+	}
+
+	if ce.trailer == nil {
+		ce.trailer = make(textproto.MIMEHeader)
+	}
+	ce.trailer.Add(key, value)
+	return nil
+}
+
+// Close the ChunkedEncoder. Flushes any unwritten data, followed by the last
+// chunk and any trailer fields.
+func (ce *ChunkedEncoder) Close() error {
+	if err := ce.usable(); err != nil {
+		return err
+	}
+	ce.closed = true
+
+	if err := ce.flush(); err != nil {
+		return err
+	}
+
+	b := append(ce.buf[:0], "0\r\n"...)
+	keys := make([]string, 0, len(ce.trailer))
+	for k := range ce.trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range ce.trailer[k] {
+			b = append(b, k...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	b = append(b, "\r\n"...)
+
+	_, err := ce.w.Write(b)
+	return err
+}
+
+// flush buffered data
+func (ce *ChunkedEncoder) flush() error {
+	if ce.ch.Len() > 0 {
+		return ce.writeChunk(ce.ch.Next(ce.ch.Len()), nil)
+	}
+	return nil
+}
+
+// writeChunk with the given extensions, with a single Write
+func (ce *ChunkedEncoder) writeChunk(chunk []byte, exts []ChunkExtension) error {
+	b := strconv.AppendUint(ce.buf[:0], uint64(len(chunk)), 16)
+	for _, ext := range exts {
+		b = append(b, ';')
+		b = append(b, ext.Name...)
+		if ext.Value != "" {
+			b = append(b, '=')
+			b = appendExtensionValue(b, ext.Value)
+		}
+	}
+	b = append(b, "\r\n"...)
+	b = append(b, chunk...)
+	b = append(b, "\r\n"...)
+
+	ce.buf = b
+	if _, ce.err = ce.w.Write(b); ce.err != nil {
+		return ce.err
+	}
+	return nil
+}
+
+// usable returns an error if the ChunkedEncoder can't be written to anymore
+func (ce *ChunkedEncoder) usable() error {
+	if ce.closed {
+		return ErrClosedEncoder
+	}
+	return ce.err
+}
+
+// ChunkedDecoder decodes a stream encoded with HTTP/1.1 chunked transfer
+// coding, by a ChunkedEncoder or any other HTTP/1.1 implementation
+type ChunkedDecoder struct {
+	r    *bufio.Reader
+	left uint64 // bytes left in the current chunk
+	exts []ChunkExtension
+	err  error
+
+	trailer textproto.MIMEHeader
+}
+
+// NewChunkedDecoder given a stream encoded with chunked transfer coding
+func NewChunkedDecoder(s io.Reader) *ChunkedDecoder {
+	return &ChunkedDecoder{r: bufio.NewReaderSize(s, maxChunkLine)}
+}
+
+// Read and decode bytes from the stream. Returns io.EOF once the last chunk
+// and trailer section have been read, or io.ErrUnexpectedEOF if the stream
+// ends before.
+func (cd *ChunkedDecoder) Read(p []byte) (n int, err error) {
+	for cd.err == nil && cd.left == 0 {
+		cd.err = cd.readChunkLine()
+	}
+	if cd.err != nil {
+		return 0, cd.err
+	}
+
+	if uint64(len(p)) > cd.left {
+		p = p[:cd.left]
+	}
+	n, err = cd.r.Read(p)
+	cd.left -= uint64(n)
+
+	// Chunk data is followed by a line break
+	if err == nil && cd.left == 0 {
+		err = cd.readCRLF()
+	}
+	if err != nil {
+		cd.err = unexpected(err)
+	}
+	return n, cd.err
+}
+
+// Extensions of the chunk last read from, or nil if it had none
+func (cd *ChunkedDecoder) Extensions() []ChunkExtension {
+	return cd.exts
+}
+
+// Trailer fields following the last chunk, once the ChunkedDecoder has
+// returned io.EOF. Returns nil until then.
+func (cd *ChunkedDecoder) Trailer() textproto.MIMEHeader {
+	if cd.err != io.EOF {
+		return nil
+	}
+	return cd.trailer
+}
+
+// readChunkLine with the size and extensions of the next chunk. Reads the
+// trailer section once the last chunk is reached.
+func (cd *ChunkedDecoder) readChunkLine() error {
+	line, err := cd.readLine()
+	if err != nil {
+		return err
+	}
+
+	i := 0
+	for i < len(line) && isHex(line[i]) {
+		i++
+	}
+	if i == 0 {
+		return ErrMalformedChunk
+	}
+	if cd.left, err = strconv.ParseUint(line[:i], 16, 64); err != nil {
+		return ErrMalformedChunk
+	}
+
+	var ok bool
+	if cd.exts, ok = parseExtensions(line[i:]); !ok {
+		return ErrMalformedChunk
+	}
+	if cd.left > 0 {
+		return nil
+	}
+
+	// The last chunk is followed by the trailer section
+	if err = cd.readTrailer(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// readTrailer section up to the empty line ending it, one bounded line at
+// a time
+func (cd *ChunkedDecoder) readTrailer() error {
+	cd.trailer = make(textproto.MIMEHeader)
+	for fields, size := 0, 0; ; fields++ {
+		line, err := cd.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		if size += len(line); fields == maxTrailerFields || size > maxTrailerSize {
+			return ErrMalformedChunk
+		}
+
+		// Obsolete line folding isn't supported, so keys can't start with
+		// whitespace either
+		key, value, ok := strings.Cut(line, ":")
+		value = strings.Trim(value, " \t")
+		if !ok || !isToken(key) || !isFieldText(value) {
+			return ErrMalformedChunk
+		}
+		cd.trailer.Add(key, value)
+	}
+}
+
+// readLine up to a line break, which is not returned. Accepts a bare LF as
+// a line break, as RFC 9112 allows.
+func (cd *ChunkedDecoder) readLine() (string, error) {
+	line, err := cd.r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return "", ErrMalformedChunk
+	case err != nil:
+		return "", unexpected(err)
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return string(line), nil
+}
+
+// readCRLF following the data of a chunk
+func (cd *ChunkedDecoder) readCRLF() error {
+	line, err := cd.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return ErrMalformedChunk
+	}
+	return nil
+}
+
+// parseExtensions following a chunk size, which are ';' separated names and
+// optional values, with optional whitespace around either
+func parseExtensions(s string) (exts []ChunkExtension, ok bool) {
+	for {
+		if s = trimBWS(s); s == "" {
+			return exts, true
+		}
+		if s[0] != ';' {
+			return nil, false
+		}
+
+		var ext ChunkExtension
+		if ext.Name, s = cutToken(trimBWS(s[1:])); ext.Name == "" {
+			return nil, false
+		}
+		if s = trimBWS(s); strings.HasPrefix(s, "=") {
+			s = trimBWS(s[1:])
+			if strings.HasPrefix(s, `"`) {
+				if ext.Value, s, ok = cutQuoted(s); !ok {
+					return nil, false
+				}
+			} else if ext.Value, s = cutToken(s); ext.Value == "" {
+				return nil, false
+			}
+		}
+		exts = append(exts, ext)
+	}
+}
+
+// appendExtensionValue as a token if it is one, or as a quoted string. The
+// value must be field text, as a quoted string can't hold other controls.
+func appendExtensionValue(b []byte, v string) []byte {
+	if isToken(v) {
+		return append(b, v...)
+	}
+
+	b = append(b, '"')
+	for i := 0; i < len(v); i++ {
+		if v[i] == '"' || v[i] == '\\' {
+			b = append(b, '\\')
+		}
+		b = append(b, v[i])
+	}
+	return append(b, '"')
+}
+
+// cutToken from the start of s, returning the token and the rest
+func cutToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// cutQuoted string from the start of s, returning its unescaped contents
+// and the rest
+func cutQuoted(s string) (string, string, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			if i++; i == len(s) {
+				return "", "", false
+			}
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+// trimBWS removes optional whitespace from the start of s
+func trimBWS(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+// isToken returns true if s is a non-empty HTTP token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldText returns true if s has no control characters other than tabs,
+// which may be part of a field value or quoted string
+func isFieldText(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar returns true if c may be part of an HTTP token
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+}
+
+// isHex returns true if c is a hexadecimal digit
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
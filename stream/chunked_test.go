@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestChunked(t *testing.T) {
+	Convey("Given data written to a ChunkedEncoder with extensions and trailers", t, func() {
+		in := randomBytes(CHUNK_SIZE*3 + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		ce := NewChunkedEncoder(&s, CHUNK_SIZE)
+		ce.Write(in[:CHUNK_SIZE/2])
+		So(ce.WriteChunk(in[CHUNK_SIZE/2:CHUNK_SIZE], ChunkExtension{"name", `a "quoted" value`}), ShouldBeNil)
+		ce.Write(in[CHUNK_SIZE:])
+		So(ce.SetTrailer("Checksum", "abc"), ShouldBeNil)
+		So(ce.Close(), ShouldBeNil)
+
+		Convey("Then a ChunkedDecoder should read it out intact", func() {
+			cd := NewChunkedDecoder(&s)
+			out, err := ioutil.ReadAll(cd)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+			So(cd.Trailer().Get("Checksum"), ShouldEqual, "abc")
+		})
+
+		Convey("Then net/http should read it as a request body", func() {
+			raw := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: Checksum\r\n\r\n"
+			req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(raw), &s)))
+			So(err, ShouldBeNil)
+
+			out, err := ioutil.ReadAll(req.Body)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+			So(req.Trailer.Get("Checksum"), ShouldEqual, "abc")
+		})
+
+		Convey("Then invalid trailer fields should be refused", func() {
+			So(NewChunkedEncoder(&s, CHUNK_SIZE).SetTrailer("Bad Key", "x"), ShouldEqual, ErrInvalidField)
+			So(NewChunkedEncoder(&s, CHUNK_SIZE).SetTrailer("Key", "x\r\ny"), ShouldEqual, ErrInvalidField)
+		})
+
+		Convey("Then extension values with control characters should be refused", func() {
+			ce := NewChunkedEncoder(&s, CHUNK_SIZE)
+			So(ce.WriteChunk(in, ChunkExtension{"name", "x\ny"}), ShouldEqual, ErrInvalidField)
+			So(ce.WriteChunk(in, ChunkExtension{"name", "x\x00"}), ShouldEqual, ErrInvalidField)
+			So(ce.WriteChunk(in, ChunkExtension{"name", "x\ty"}), ShouldBeNil)
+		})
+
+		Convey("Then a chunk size which isn't positive should be refused", func() {
+			for _, size := range []int{0, -1} {
+				_, err := NewChunkedEncoder(&s, size).Write(in)
+				So(err, ShouldEqual, ErrInvalidSize)
+			}
+		})
+	})
+
+	Convey("Given a chunked body written by net/http", t, func() {
+		in := randomBytes(CHUNK_SIZE * 2)
+		var s bytes.Buffer
+		cw := httputil.NewChunkedWriter(&s)
+		cw.Write(in)
+		cw.Close()
+		s.WriteString("\r\n")
+
+		Convey("Then a ChunkedDecoder should read it out intact", func() {
+			out, err := ioutil.ReadAll(NewChunkedDecoder(&s))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+	})
+
+	Convey("Given a chunked body with extensions", t, func() {
+		s := "4 ; a=1;b = \"x\\\"y\"\r\nWiki\r\n5;c\r\npedia\r\n0\r\nExpires: never\r\nX-Other: 1\r\n\r\n"
+		cd := NewChunkedDecoder(strings.NewReader(s))
+
+		Convey("Then each chunk's extensions should be available while reading it", func() {
+			buf := make([]byte, 10)
+			n, err := cd.Read(buf)
+			So(err, ShouldBeNil)
+			So(string(buf[:n]), ShouldEqual, "Wiki")
+			So(cd.Extensions(), ShouldResemble, []ChunkExtension{{"a", "1"}, {"b", `x"y`}})
+
+			n, err = cd.Read(buf)
+			So(err, ShouldBeNil)
+			So(string(buf[:n]), ShouldEqual, "pedia")
+			So(cd.Extensions(), ShouldResemble, []ChunkExtension{{"c", ""}})
+
+			_, err = cd.Read(buf)
+			So(err, ShouldEqual, io.EOF)
+			So(cd.Trailer().Get("Expires"), ShouldEqual, "never")
+			So(cd.Trailer().Get("X-Other"), ShouldEqual, "1")
+		})
+	})
+
+	Convey("Given malformed chunked bodies", t, func() {
+		for _, s := range []string{
+			"x\r\nabc\r\n0\r\n\r\n",
+			"3\r\nabcd\r\n0\r\n\r\n",
+			"3;\r\nabc\r\n0\r\n\r\n",
+			"3;a=\"b\r\nabc\r\n0\r\n\r\n",
+			"11112222333344445\r\n",
+		} {
+			_, err := ioutil.ReadAll(NewChunkedDecoder(strings.NewReader(s)))
+			So(err, ShouldEqual, ErrMalformedChunk)
+		}
+
+		Convey("Then ones with oversized trailers should be refused", func() {
+			for _, trailer := range []string{
+				"Key: " + strings.Repeat("x", maxChunkLine) + "\r\n",
+				strings.Repeat("Key: "+strings.Repeat("x", maxChunkLine/2)+"\r\n", 40),
+				strings.Repeat("Key: x\r\n", maxTrailerFields+1),
+			} {
+				_, err := ioutil.ReadAll(NewChunkedDecoder(strings.NewReader("3\r\nabc\r\n0\r\n" + trailer + "\r\n")))
+				So(err, ShouldEqual, ErrMalformedChunk)
+			}
+		})
+
+		Convey("Then truncated ones should fail as unexpected EOF", func() {
+			_, err := ioutil.ReadAll(NewChunkedDecoder(strings.NewReader("3\r\nab")))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			_, err = ioutil.ReadAll(NewChunkedDecoder(strings.NewReader("3\r\nabc\r\n0\r\n")))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+	})
+}
@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Codec compresses chunks of a stream, each independently of the others
+type Codec interface {
+	// ID identifies the codec within stream headers. IDs below 128 are
+	// reserved for codecs of this package.
+	ID() byte
+
+	// Compress src, appending the result to dst
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress src, appending the result to dst. Fails if src decompresses
+	// to more than limit bytes.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+var errDecompressLimit = errors.New("decompressed chunk exceeds limit")
+
+// Codecs included in this package, registered by default
+var (
+	Flate Codec = &flateCodec{level: flate.DefaultCompression}
+	Gzip  Codec = &gzipCodec{level: gzip.DefaultCompression}
+)
+
+var (
+	codecs     = make(map[byte]Codec)
+	codecsLock sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(Flate)
+	RegisterCodec(Gzip)
+}
+
+// RegisterCodec makes a codec available to Decoders. It replaces any codec
+// previously registered under the same ID.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.ID()] = c
+}
+
+// lookupCodec registered under the given ID
+func lookupCodec(id byte) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+// decompress from a reader into dst, up to the given limit
+func decompress(dst []byte, r io.Reader, limit int) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > int64(limit) {
+		return dst, errDecompressLimit
+	}
+	return buf.Bytes(), nil
+}
+
+// flateCodec compresses chunks as raw DEFLATE data. Compressors are pooled,
+// as they are expensive to create.
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *flateCodec) ID() byte { return 1 }
+
+func (c *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(buf, c.level); err != nil {
+			return dst, err
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	r, ok := c.readers.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(src))
+	}
+	defer c.readers.Put(r)
+
+	return decompress(dst, r, limit)
+}
+
+// gzipCodec compresses chunks as individual gzip members
+type gzipCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *gzipCodec) ID() byte { return 2 }
+
+func (c *gzipCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = gzip.NewWriterLevel(buf, c.level); err != nil {
+			return dst, err
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	var err error
+	r, ok := c.readers.Get().(*gzip.Reader)
+	if ok {
+		err = r.Reset(bytes.NewReader(src))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return dst, err
+	}
+	defer c.readers.Put(r)
+
+	return decompress(dst, r, limit)
+}
@@ -1,66 +1,445 @@
 package stream
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"io"
+	"sync/atomic"
+	"time"
 )
 
 type Decoder struct {
-	s      io.Reader
-	size   int
-	chLeft int
-	last   bool
+	fr         FrameReader
+	config     config
+	readHeader bool
+	ahead      *readAhead // reads frames instead of fr, with concurrency
+
+	chunk []byte // current decoded chunk
+	off   int    // read position within chunk
+	read  int64  // decoded bytes read so far
+	err   error
+
+	sequence uint64 // sequence number of the chunk after the current one
+
+	trailer *Trailer
+	digest  hash.Hash // of all decoded data, with flagTrailer
+	length  int64     // decoded bytes, with flagTrailer
+
+	lastFrame atomic.Int64 // arrival of the last frame, in Unix nanoseconds
+
+	cache    *chunkCache // of chunks decoded, with flagDeduped
+	verifier *verifier   // holds chunks until verified, given a public key
+
+	ctx  context.Context // ends decoding once done, if not nil
+	stop func() bool     // stops ctx from interrupting the source
+}
+
+// CorruptionError reports a frame which failed its checksum or couldn't be
+// decoded. Frame counts frames of every kind, such as heartbeats and
+// parity, while Chunk only counts those standing for chunks of data.
+type CorruptionError struct {
+	Frame  int64 // index of the frame within the stream
+	Chunk  int64 // index of the chunk, or of the next one if the frame isn't
+	Offset int64 // byte offset of the frame within the encoded stream
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt frame %d (chunk %d) at offset %d", e.Frame, e.Chunk, e.Offset)
 }
 
-// NewDecoder given an encoded stream and chunk size
-func NewDecoder(s io.Reader, size int) *Decoder {
+// NewDecoder given an encoded stream. The chunk size and features of the
+// stream are taken from its header. Options given here are requirements: a
+// Decoder created WithChecksum refuses streams without checksums, and one
+// created WithAEAD refuses unsealed streams.
+func NewDecoder(s io.Reader, opts ...Option) *Decoder {
 	return &Decoder{
-		s:      s,
-		size:   size,
-		chLeft: 0,
-		last:   false,
+		fr:     FrameReader{r: s},
+		config: newConfig(opts),
 	}
 }
 
-// Read and decode bytes from the encoded stream
+// NewDecoderContext is like NewDecoder, but the Decoder gives up once ctx
+// is done, returning ctx.Err() from then on. Reads of the stream blocked at
+// the time, including any reading ahead, are interrupted as by ReadContext.
+// Once the Decoder has ended, ctx no longer affects the stream, so it can
+// be read further.
+func NewDecoderContext(ctx context.Context, s io.Reader, opts ...Option) *Decoder {
+	d := NewDecoder(s, opts...)
+	d.ctx = ctx
+	d.stop = context.AfterFunc(ctx, func() {
+		interruptRead(s)
+	})
+	return d
+}
+
+// Read and decode bytes from the encoded stream. Returns io.EOF once the
+// stream's terminator is reached, io.ErrUnexpectedEOF if the stream ends
+// without one, or a *RemoteError if the producer ended it with an error.
 func (d *Decoder) Read(p []byte) (n int, err error) {
-	// Decode and read needed full chunks
-	for d.chLeft < len(p)-n {
-		m, err := d.s.Read(p[n : n+d.chLeft])
-		n += m
-		d.chLeft -= m
-		if err != nil {
-			return n, err
+	if err = d.start(); err != nil {
+		return
+	}
+
+	// Decode the next chunk once the current one is consumed
+	for d.off == len(d.chunk) {
+		if d.err = d.end(d.decodeChunk()); d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	n = copy(p, d.chunk[d.off:])
+	d.off += n
+	d.read += int64(n)
+	return
+}
+
+// WriteTo decodes the rest of the stream into w, writing
+// each chunk straight from where it was decoded. Returns
+// nil once the stream's terminator is reached.
+func (d *Decoder) WriteTo(w io.Writer) (n int64, err error) {
+	if err = d.start(); err != nil {
+		if err == io.EOF {
+			err = nil
 		}
+		return
+	}
 
-		if d.chLeft == 0 && d.last {
-			return n, io.EOF
+	for {
+		if d.off < len(d.chunk) {
+			m, werr := w.Write(d.chunk[d.off:])
+			d.off += m
+			d.read += int64(m)
+			n += int64(m)
+			if werr != nil {
+				return n, werr
+			}
 		}
 
-		if d.chLeft == 0 {
-			if d.chLeft, err = d.decodeSize(); d.chLeft < d.size {
-				d.last = true
+		if d.err = d.end(d.decodeChunk()); d.err != nil {
+			if d.err == io.EOF {
+				return n, nil
+			}
+			return n, d.err
+		}
+	}
+}
+
+// ReadByte decodes a single byte from the encoded stream
+func (d *Decoder) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := d.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// start decoding the stream by reading its header, if that hasn't happened
+// yet. Returns any error which ended decoding.
+func (d *Decoder) start() error {
+	if d.err == nil && d.ctx != nil {
+		d.err = d.end(d.ctx.Err())
+	}
+	if d.err == nil && !d.readHeader {
+		d.err = d.end(d.decodeHeader())
+	}
+	return d.err
+}
+
+// end decoding with the given error, if there is one, which stops any
+// reading ahead. Errors reading the stream are put down to the Decoder's
+// context if that's done, and the context stops affecting the stream.
+func (d *Decoder) end(err error) error {
+	if err != nil && d.ahead != nil {
+		d.ahead.stop()
+	}
+	if err == nil || d.ctx == nil {
+		return err
+	}
+	d.stop()
+	if d.ctx.Err() != nil && err != io.EOF {
+		return d.ctx.Err()
+	}
+	return err
+}
+
+// ReadContext is like Read, but gives up once ctx is done, returning
+// ctx.Err(). A read of the stream blocked at the time is interrupted by
+// setting a read deadline in the past, if the stream supports them, which
+// is cleared again afterwards. Otherwise the stream is closed, if it is an
+// io.Closer. Either may leave a frame partly read, so the Decoder
+// returns ctx.Err() from then on.
+func (d *Decoder) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		interruptRead(d.fr.r)
+	})
+	n, err = d.Read(p)
+	if stop() {
+		return
+	}
+
+	<-interrupted
+	if rd, ok := d.fr.r.(readDeadliner); ok {
+		rd.SetReadDeadline(time.Time{})
+	}
+	d.err = d.end(ctx.Err())
+	return n, d.err
+}
+
+// readDeadliner is a stream whose blocked reads can be interrupted by a
+// deadline, such as a net.Conn or an *os.File
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// interruptRead of the given stream which may be blocked, if it can be
+func interruptRead(s io.Reader) {
+	if rd, ok := s.(readDeadliner); ok && rd.SetReadDeadline(time.Unix(1, 0)) == nil {
+		return
+	}
+	if c, ok := s.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// decodeHeader reads the stream header and checks that it satisfies the
+// Decoder's options
+func (d *Decoder) decodeHeader() error {
+	if err := d.fr.readHeader(d.config); err != nil {
+		return err
+	}
+
+	// Channels and windows are for a Mux or Session to handle
+	if d.fr.header.has(flagChannels) || d.fr.header.has(flagWindowed) {
+		return ErrIncompatible
+	}
+	if d.fr.header.has(flagTrailer) {
+		d.digest = sha256.New()
+	}
+	if d.fr.header.has(flagDeduped) {
+		d.cache = newChunkCache(d.fr.header.cache)
+	}
+	if d.config.publicKey != nil {
+		d.verifier = newVerifier(d.config.publicKey, d.fr.header)
+	}
+	d.sequence = d.fr.header.start.Sequence
+	d.readHeader = true
+
+	if d.config.concurrency > 1 && d.fr.header.has(flagCompressed) {
+		d.ahead = startReadAhead(&d.fr, d.config.concurrency, &d.lastFrame)
+	}
+	return nil
+}
+
+// Checkpoint of the data read so far, for a sequenced stream. Once that
+// data is processed durably, a transfer which breaks off may resume from
+// there with NewResumedEncoder. Returns the zero Checkpoint for a stream
+// without sequence numbers.
+func (d *Decoder) Checkpoint() Checkpoint {
+	if !d.fr.header.has(flagSequenced) {
+		return Checkpoint{}
+	}
+	start := d.fr.header.start
+	cp := Checkpoint{Sequence: d.sequence, Offset: start.Offset + d.read}
+
+	// The next byte may still be in the current chunk
+	if d.off < len(d.chunk) {
+		cp.Sequence--
+	}
+	return cp
+}
+
+// LastFrame is when the Decoder last read a frame of any kind, including
+// heartbeats, or the zero Time if it hasn't read any yet. It is safe to
+// call while a Read is blocked, so a watchdog can tell a dead producer from
+// an idle one.
+func (d *Decoder) LastFrame() time.Time {
+	if ns := d.lastFrame.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Trailer of the stream, once the Decoder has returned io.EOF after
+// verifying the stream against it. Returns nil until then, or if the stream
+// has no trailer.
+func (d *Decoder) Trailer() *Trailer {
+	if d.err != io.EOF {
+		return nil
+	}
+	return d.trailer
+}
+
+// decodeChunk reads frames until the next chunk of data or the end of the
+// stream. Data of a chunk is never handed out before the entire chunk has
+// been read and verified, nor before a signature covering it has been, if
+// the Decoder was given a public key.
+func (d *Decoder) decodeChunk() error {
+	for {
+		if d.verifier != nil && len(d.verifier.verified) > 0 {
+			hc := d.verifier.next()
+			if hc.typ.custom() {
+				if err := d.handle(Frame{Type: hc.typ, Payload: hc.chunk}); err != nil {
+					return err
+				}
+				continue
 			}
+			d.deliver(hc.chunk, hc.sequence)
+			return nil
 		}
+
+		f, err := d.readFrame()
 		if err != nil {
-			return n, err
+			return unexpected(err)
+		}
+
+		switch {
+		case f.Type == FrameData:
+			if err := d.decodeData(f); err != nil || d.verifier == nil {
+				return err
+			}
+		case f.Type == FrameRef && d.cache != nil:
+			if err := d.decodeRef(f); err != nil || d.verifier == nil {
+				return err
+			}
+		case f.Type == FrameSignature && d.verifier != nil:
+			if err := d.verifier.verify(f.Payload); err != nil {
+				return err
+			}
+		case f.Type == FrameSignature && d.fr.header.has(flagSigned):
+			// Only of use given the public key, which the Decoder wasn't
+		case f.Type == FrameEnd:
+			if d.digest != nil && d.trailer == nil {
+				return d.corrupt()
+			}
+			if d.verifier != nil && !d.verifier.complete() {
+				return ErrSignature
+			}
+			return io.EOF
+		case f.Type == FrameHeartbeat:
+			// Only a sign of life, already taken note of
+		case f.Type == FrameError:
+			if re, ok := parseRemoteError(f.Payload); ok {
+				return re
+			}
+			return d.corrupt()
+		case f.Type == FrameTrailer && d.digest != nil && d.trailer == nil:
+			if err := d.decodeTrailer(f); err != nil {
+				return err
+			}
+			if d.verifier != nil {
+				if err := d.verifier.add(FrameTrailer, f.Payload); err != nil {
+					return err
+				}
+			}
+		case f.Type == FrameTrailer && d.trailer != nil:
+			return d.corrupt()
+		case f.Type == FrameIndex && d.fr.header.has(flagIndexed):
+			// Only of use when seeking, which a Decoder can't
+		case f.Type == FrameParity && d.fr.header.has(flagParity):
+			// Only of use when chunks are lost, which they can't be here
+		case f.Type.custom() && d.verifier != nil:
+			if err := d.verifier.holdFrame(f); err != nil {
+				return err
+			}
+		case f.Type.custom():
+			if err := d.handle(f); err != nil {
+				return err
+			}
+		default:
+			return ErrIncompatible
 		}
 	}
+}
 
-	// Read portion of current decoded chunk
-	m, err := d.s.Read(p[n:])
-	n += m
-	d.chLeft -= m
-	return
+// readFrame from the stream, or from those read ahead
+func (d *Decoder) readFrame() (Frame, error) {
+	if d.ahead != nil {
+		return d.ahead.next()
+	}
+
+	f, err := d.fr.ReadFrame()
+	if err == nil {
+		d.lastFrame.Store(time.Now().UnixNano())
+	}
+	return f, err
+}
+
+// corrupt builds an error describing the frame last read
+func (d *Decoder) corrupt() error {
+	if d.ahead != nil {
+		return d.ahead.cur.corrupt()
+	}
+	return d.fr.corrupt()
+}
+
+// decodeData makes the payload of a data frame the current chunk
+func (d *Decoder) decodeData(f Frame) error {
+	var chunk []byte
+	var err error
+	if d.ahead != nil {
+		chunk, err = d.ahead.data()
+	} else {
+		chunk, err = d.fr.Data(f)
+	}
+	if err != nil {
+		return err
+	}
+	if d.cache != nil {
+		d.cache.add(sha256.Sum256(chunk), chunk)
+	}
+	return d.decoded(f, chunk)
+}
+
+// decoded takes note of the chunk decoded from the given frame, and makes
+// it current, unless it must be verified first
+func (d *Decoder) decoded(f Frame, chunk []byte) error {
+	if d.digest != nil {
+		d.digest.Write(chunk)
+		d.length += int64(len(chunk))
+	}
+	if d.verifier != nil {
+		return d.verifier.hold(chunk, f.Sequence)
+	}
+	d.deliver(chunk, f.Sequence)
+	return nil
+}
+
+// handle a custom frame with the handler registered for its type, if any
+func (d *Decoder) handle(f Frame) error {
+	if h, ok := d.config.handlers[f.Type]; ok {
+		return h(f)
+	}
+	return nil
 }
 
-// decodeSize of the next chunk by reading in an encoded unsigned integer. It
-// may return an error if the underlying stream errors out.
-func (d *Decoder) decodeSize() (size int, err error) {
-	szb := make([]byte, binary.Size(uint64(d.size)))
-	if _, err = d.s.Read(szb); err != nil {
-		return -1, err
+// deliver a chunk with the given sequence number, making it current
+func (d *Decoder) deliver(chunk []byte, sequence uint64) {
+	d.chunk, d.off = chunk, 0
+	if d.fr.header.has(flagSequenced) {
+		d.sequence = sequence + 1
+	}
+}
+
+// decodeTrailer and verify the data decoded so far against it
+func (d *Decoder) decodeTrailer(f Frame) error {
+	t, ok := parseTrailer(f.Payload)
+	if !ok {
+		return d.corrupt()
+	}
+
+	var sum [sha256.Size]byte
+	d.digest.Sum(sum[:0])
+	if t.Length != d.length || t.SHA256 != sum {
+		return ErrTrailerMismatch
 	}
-	sz, _ := binary.Uvarint(szb)
-	return int(sz), nil
+	d.trailer = t
+	return nil
 }
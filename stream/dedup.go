@@ -0,0 +1,142 @@
+package stream
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+var ErrChunkSizes = errors.New("invalid content-defined chunk sizes")
+
+// gear maps each byte to a pseudorandom value for the rolling hash of
+// content-defined chunking. It is generated with SplitMix64, so it's the
+// same everywhere.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x6d6f7265696f)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return
+}()
+
+// chunker finds content-defined chunk boundaries with a gear hash, as in
+// FastCDC. A boundary is cut where the top bits of the hash are all zero:
+// more of them before the average size, and fewer after, which keeps chunk
+// sizes close to it. The hash rolls on across chunks, so its top bits only
+// ever depend on the last 64 bytes.
+type chunker struct {
+	min, avg, max int
+	small, large  uint64 // masks before and after the average size
+	hash          uint64
+}
+
+// newChunker for chunks of the given sizes
+func newChunker(min, avg, max int) (*chunker, error) {
+	if min <= 0 || avg <= min || max < avg {
+		return nil, ErrChunkSizes
+	}
+	n := bits.Len(uint(avg)) - 1
+	return &chunker{
+		min:   min,
+		avg:   avg,
+		max:   max,
+		small: ^uint64(0) << (64 - n - 1),
+		large: ^uint64(0) << (64 - n + 1),
+	}, nil
+}
+
+// cut returns how much of p belongs to a chunk holding n bytes so far, and
+// whether that completes the chunk
+func (c *chunker) cut(n int, p []byte) (int, bool) {
+	for i, b := range p {
+		c.hash = c.hash<<1 + gear[b]
+		if n++; n <= c.min {
+			continue
+		}
+
+		mask := c.large
+		if n < c.avg {
+			mask = c.small
+		}
+		if c.hash&mask == 0 || n >= c.max {
+			return i + 1, true
+		}
+	}
+	return len(p), false
+}
+
+// chunkCache holds the chunks most recently sent, by digest, up to a total
+// size. Encoders and Decoders keep identical caches by adding and looking
+// up the same chunks in the same order.
+type chunkCache struct {
+	max, size int
+	entries   map[[sha256.Size]byte]*list.Element
+	lru       list.List // of *cachedChunk, most recently used first
+}
+
+// cachedChunk is a chunk held by a chunkCache
+type cachedChunk struct {
+	sum   [sha256.Size]byte
+	chunk []byte
+}
+
+// newChunkCache holding up to max bytes of chunks
+func newChunkCache(max int) *chunkCache {
+	return &chunkCache{max: max, entries: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+// lookup the chunk with the given digest, making it the most recently used
+func (cc *chunkCache) lookup(sum [sha256.Size]byte) ([]byte, bool) {
+	el, ok := cc.entries[sum]
+	if !ok {
+		return nil, false
+	}
+	cc.lru.MoveToFront(el)
+	return el.Value.(*cachedChunk).chunk, true
+}
+
+// add a copy of a chunk with the given digest, evicting the least recently
+// used chunks while the cache is too large
+func (cc *chunkCache) add(sum [sha256.Size]byte, chunk []byte) {
+	if _, ok := cc.lookup(sum); ok {
+		return
+	}
+	cc.entries[sum] = cc.lru.PushFront(&cachedChunk{sum, append([]byte(nil), chunk...)})
+	cc.size += len(chunk)
+
+	for cc.size > cc.max {
+		cached := cc.lru.Remove(cc.lru.Back()).(*cachedChunk)
+		delete(cc.entries, cached.sum)
+		cc.size -= len(cached.chunk)
+	}
+}
+
+// writeDeduped writes a reference in place of a chunk if it's cached, or
+// else caches it and writes it as usual
+func (e *Encoder) writeDeduped(chunk, compressed []byte) error {
+	sum := sha256.Sum256(chunk)
+	if _, ok := e.cache.lookup(sum); ok {
+		return e.fw.WriteFrame(Frame{Type: FrameRef, Payload: sum[:]})
+	}
+	e.cache.add(sum, chunk)
+	return e.fw.writeCompressed(0, chunk, compressed)
+}
+
+// decodeRef resolves a reference to a chunk sent before
+func (d *Decoder) decodeRef(f Frame) error {
+	var sum [sha256.Size]byte
+	if len(f.Payload) != len(sum) {
+		return d.corrupt()
+	}
+	copy(sum[:], f.Payload)
+
+	chunk, ok := d.cache.lookup(sum)
+	if !ok {
+		return d.corrupt()
+	}
+	return d.decoded(f, chunk)
+}
@@ -0,0 +1,180 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// cdcChunks cuts data into content-defined chunks of the given sizes
+func cdcChunks(data []byte, min, avg, max int) (chunks []string) {
+	c, err := newChunker(min, avg, max)
+	if err != nil {
+		panic(err)
+	}
+	for len(data) > 0 {
+		m, _ := c.cut(0, data)
+		chunks, data = append(chunks, string(data[:m])), data[m:]
+	}
+	return
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	Convey("Given data cut into content-defined chunks", t, func() {
+		in := randomBytes(1 << 18)
+		chunks := cdcChunks(in, 256, 1024, 4096)
+
+		Convey("Then chunks should be within the size limits", func() {
+			for i, c := range chunks {
+				So(len(c), ShouldBeLessThanOrEqualTo, 4096)
+				if i < len(chunks)-1 {
+					So(len(c), ShouldBeGreaterThan, 256)
+				}
+			}
+			So(len(in)/len(chunks), ShouldBeBetween, 1024/2, 1024*2)
+		})
+
+		Convey("When a byte is inserted", func() {
+			mid := len(in) / 2
+			edited := append(append(append([]byte(nil), in[:mid]...), 42), in[mid:]...)
+			after := cdcChunks(edited, 256, 1024, 4096)
+
+			Convey("Then only the chunks around it should change", func() {
+				seen := make(map[string]bool)
+				for _, c := range chunks {
+					seen[c] = true
+				}
+				changed := 0
+				for _, c := range after {
+					if !seen[c] {
+						changed++
+					}
+				}
+				So(changed, ShouldBeLessThanOrEqualTo, 5)
+			})
+		})
+	})
+
+	Convey("Given an encoder with content-defined chunking", t, func() {
+		in := randomBytes(CHUNK_SIZE * 20)
+		opts := []Option{WithContentDefinedChunking(CHUNK_SIZE/8, CHUNK_SIZE/2), WithChecksum()}
+
+		var whole, pieces bytes.Buffer
+		e := NewEncoder(&whole, CHUNK_SIZE, opts...)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then chunks should be cut the same however data is written", func() {
+			e := NewEncoder(&pieces, CHUNK_SIZE, opts...)
+			_, err := e.ReadFrom(iotest.OneByteReader(bytes.NewReader(in)))
+			So(err, ShouldBeNil)
+			So(e.Close(), ShouldBeNil)
+			So(pieces.Bytes(), ShouldResemble, whole.Bytes())
+		})
+
+		Convey("Then the stream should decode", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&whole))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+	})
+
+	Convey("Given chunk sizes which don't fit the encoder", t, func() {
+		e := NewEncoder(ioutil.Discard, CHUNK_SIZE, WithContentDefinedChunking(CHUNK_SIZE/2, CHUNK_SIZE*2))
+
+		Convey("Then the encoder should refuse writes", func() {
+			_, err := e.Write([]byte{1})
+			So(err, ShouldEqual, ErrChunkSizes)
+		})
+	})
+}
+
+func TestDeduplication(t *testing.T) {
+	Convey("Given data repeating itself", t, func() {
+		a, b := randomBytes(CHUNK_SIZE*10), randomBytes(CHUNK_SIZE*5)
+		in := bytes.Join([][]byte{a, b, a, b[CHUNK_SIZE:], a}, nil)
+		chunking := WithContentDefinedChunking(CHUNK_SIZE/8, CHUNK_SIZE/2)
+
+		Convey("When encoded with deduplication", func() {
+			opts := []Option{chunking, WithDeduplication(len(in)), WithSequence(), WithTrailer(), WithChecksum(), WithCompression(Flate)}
+			var s bytes.Buffer
+			e := NewEncoder(&s, CHUNK_SIZE, opts...)
+			e.Write(in)
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then repeated content should only be sent once", func() {
+				So(s.Len(), ShouldBeLessThan, len(in)*2/3)
+			})
+
+			Convey("Then the stream should decode", func() {
+				d := NewDecoder(bytes.NewReader(s.Bytes()))
+				out, err := ioutil.ReadAll(d)
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+				So(d.Trailer(), ShouldNotBeNil)
+			})
+
+			Convey("Then the stream should decode with concurrency", func() {
+				out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(s.Bytes()), WithConcurrency(4)))
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+
+			Convey("Then a SeekableDecoder should refuse it, even if indexed", func() {
+				var s bytes.Buffer
+				e := NewEncoder(&s, CHUNK_SIZE, append(opts, WithIndex())...)
+				e.Write(in)
+				So(e.Close(), ShouldBeNil)
+
+				_, err := NewSeekableDecoder(bytes.NewReader(s.Bytes()), int64(s.Len()))
+				So(err, ShouldEqual, ErrIncompatible)
+			})
+		})
+	})
+
+	Convey("Given data repeating part of itself after a while", t, func() {
+		a, b := randomBytes(CHUNK_SIZE*10), randomBytes(CHUNK_SIZE*10)
+		in := bytes.Join([][]byte{a, b, b, a}, nil)
+		chunking := WithContentDefinedChunking(CHUNK_SIZE/8, CHUNK_SIZE/2)
+
+		Convey("When encoded with a cache too small for all repeats", func() {
+			var small, none bytes.Buffer
+			e := NewEncoder(&small, CHUNK_SIZE, chunking, WithDeduplication(len(b)*3/2))
+			e.Write(in)
+			So(e.Close(), ShouldBeNil)
+			e = NewEncoder(&none, CHUNK_SIZE, chunking)
+			e.Write(in)
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then only content repeated soon enough should be deduplicated", func() {
+				So(small.Len(), ShouldBeLessThan, none.Len()-len(b)/3)
+				So(small.Len(), ShouldBeGreaterThan, none.Len()-len(b)-CHUNK_SIZE)
+			})
+
+			Convey("Then the stream should decode", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&small))
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+		})
+	})
+
+	Convey("Given a reference to a chunk never sent", t, func() {
+		in := randomBytes(10)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithDeduplication(CHUNK_SIZE))
+		e.Write(in)
+		e.Flush()
+		So(e.fw.WriteFrame(Frame{Type: FrameRef, Payload: make([]byte, sha256.Size)}), ShouldBeNil)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then the decoder should report corruption", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s))
+			So(out, ShouldResemble, in)
+			So(err, ShouldHaveSameTypeAs, &CorruptionError{})
+		})
+	})
+}
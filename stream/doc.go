@@ -0,0 +1,42 @@
+/*
+stream encodes and decodes streams of undefined length.
+
+An Encoder cuts the data written to it into chunks, and writes each chunk as
+a frame with its length in front. A short header records the chunk size and
+enabled features, so a Decoder needs no configuration. Chunks may optionally
+be checksummed, compressed and sealed with an authenticated cipher, and
+compression may run on several cores at once.
+
+A stream may also carry:
+
+  - a trailer recording its length and SHA-256 digest, along with producer
+    metadata, which Decoders verify
+  - an error ending it in place of the terminator, when its producer fails
+    midway, which Decoders tell apart from a clean end
+  - heartbeats, keeping connections alive while an Encoder is idle
+  - an index of its chunks, which a SeekableDecoder uses for random access
+  - sequence numbers, so a broken transfer can resume from the Checkpoint the
+    receiver last processed
+  - parity every few chunks, from which a DatagramDecoder reading it over a
+    lossy transport such as UDP reconstructs lost chunks
+  - references to repeated chunks, resolved from a cache the Decoder keeps,
+    and chunks cut where the content calls for it
+  - Ed25519 signatures over the chained digests of its chunks, so Decoders
+    given the public key read nothing a signature doesn't cover
+  - frames of application-defined types, interleaved with the data
+
+A Mux carries many logical channels over one connection using the same
+framing, and a Session adds windowed acknowledgements, so producers are held
+back by the consumer on the other side. A FrameReader and FrameWriter expose
+the frames making up a stream.
+
+Decoder reads can be bound to a context, which interrupts a blocked source
+once it's done. Decoders refuse chunks larger than a configurable maximum,
+and grow their buffers only as data arrives, so hostile input can't make
+them allocate much more than it holds.
+
+For interoperability, a ChunkedEncoder and ChunkedDecoder speak HTTP/1.1
+chunked transfer coding (RFC 9112) instead, with chunk extensions and
+trailers.
+*/
+package stream
@@ -1,53 +1,445 @@
 package stream
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"hash"
 	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosedEncoder = errors.New("closed encoder")
+	ErrFrameType     = errors.New("frame type reserved")
+	ErrFrameTooLarge = errors.New("frame payload larger than a chunk")
 )
 
 type Encoder struct {
-	s    io.Writer
+	fw   FrameWriter
 	size int
-	ch   bytes.Buffer
+	ch   []byte // data buffered for the next chunk
+	err  error
+
+	concurrency int
+	pending     []*compressJob // chunks being compressed, in order
+	free        []*compressJob
+
+	index   chunkIndex
+	indexed bool
+	parity  *parityGroup
+	chunker *chunker    // cuts chunks, with content-defined chunking
+	cache   *chunkCache // of chunks sent, with deduplication
+	signer  *signer
+	trailer *Trailer
+	digest  hash.Hash
+
+	lock              sync.Mutex
+	flushInterval     time.Duration
+	flushTimer        *time.Timer
+	heartbeatInterval time.Duration
+	heartbeatTimer    *time.Timer
+	closed            bool
 }
 
 // NewEncoder given a stream to write encoded chunks
-// to and the chunk size.
-func NewEncoder(s io.Writer, size int) *Encoder {
-	var ch bytes.Buffer
-	return &Encoder{s, size, ch}
+// to and the chunk size. The stream starts with a
+// header describing the chunk size and options, so
+// a Decoder needs neither.
+func NewEncoder(s io.Writer, size int, opts ...Option) *Encoder {
+	c := newConfig(opts)
+	e := &Encoder{
+		size:              size,
+		concurrency:       c.concurrency,
+		indexed:           c.index,
+		flushInterval:     c.flushInterval,
+		heartbeatInterval: c.heartbeatInterval,
+	}
+	e.fw, e.err = newFrameWriter(s, size, c)
+	if c.parity > 0 {
+		e.parity = &parityGroup{k: c.parity}
+	}
+	if c.minChunk > 0 || c.avgChunk > 0 {
+		if chunker, err := newChunker(c.minChunk, c.avgChunk, size); err != nil {
+			e.err = err
+		} else {
+			e.chunker = chunker
+		}
+	}
+	if c.dedup > 0 {
+		e.cache = newChunkCache(c.dedup)
+	}
+	if c.privateKey != nil {
+		if len(c.privateKey) != ed25519.PrivateKeySize {
+			e.err = ErrSignature
+		}
+		e.signer = &signer{key: c.privateKey, every: c.signEvery, chain: newChain(e.fw.header)}
+	}
+	if c.trailer {
+		e.trailer = &Trailer{Fields: make(map[string]string)}
+		e.digest = sha256.New()
+	}
+	if e.err == nil && e.heartbeatInterval > 0 {
+		// The first heartbeat may fire before the timer is stored
+		e.lock.Lock()
+		e.heartbeatTimer = time.AfterFunc(e.heartbeatInterval, e.heartbeat)
+		e.lock.Unlock()
+	}
+	return e
 }
 
 // Write data into the Encoder. Written data won't be
 // flushed to the stream until enough is present to
-// encode a chunk.
+// encode a chunk, Flush is called, or the flush
+// interval passes.
 func (e *Encoder) Write(p []byte) (n int, err error) {
-	if n, err = e.ch.Write(p); err != nil {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err = e.usable(); err != nil {
 		return
 	}
 
-	for e.ch.Len() > e.size {
-		if _, err = e.encode(e.size); err != nil {
-			return
+	for len(p) > 0 {
+		m, whole := e.cut(p)
+
+		// Whole chunks skip the buffer, unless data is
+		// already waiting in it
+		if len(e.ch) == 0 && whole {
+			if err = e.encode(p[:m]); err != nil {
+				return
+			}
+			n, p = n+m, p[m:]
+			continue
+		}
+
+		if e.ch == nil {
+			e.ch = make([]byte, 0, e.size)
 		}
+		e.ch = append(e.ch, p[:m]...)
+		n, p = n+m, p[m:]
+
+		if whole {
+			if err = e.encode(e.ch); err != nil {
+				return
+			}
+			e.ch = e.ch[:0]
+		}
+	}
+
+	// Make sure the remainder doesn't wait too long
+	if len(e.ch) > 0 && e.flushInterval > 0 && e.flushTimer == nil {
+		e.flushTimer = time.AfterFunc(e.flushInterval, e.autoFlush)
 	}
 	return
 }
 
-// encode a chunk of specified length into the stream
-func (e *Encoder) encode(sz int) (n int, err error) {
-	szb := make([]byte, binary.Size(uint64(e.size)))
-	binary.PutUvarint(szb, uint64(sz))
-	e.s.Write(szb)
+// ReadFrom encodes everything read from r until io.EOF.
+// The Encoder is only locked while encoding, so the
+// flush interval and heartbeats still apply while r
+// blocks.
+func (e *Encoder) ReadFrom(r io.Reader) (n int64, err error) {
+	// The buffer is only as large as a chunk once the size is known valid
+	e.lock.Lock()
+	err = e.usable()
+	e.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, e.size)
+	for {
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			if _, err = e.Write(buf[:m]); err != nil {
+				return
+			}
+			n += int64(m)
+		}
+
+		switch rerr {
+		case nil:
+		case io.EOF:
+			return n, nil
+		default:
+			return n, rerr
+		}
+	}
+}
+
+// Flush any buffered data to the stream as a partial
+// chunk, without ending the stream
+func (e *Encoder) Flush() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
 
-	m, err := io.CopyN(e.s, &e.ch, int64(sz))
-	return int(m), err
+	if err := e.usable(); err != nil {
+		return err
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.sign(false)
+}
+
+// SetTrailer sets a field of the stream's Trailer, which
+// is written when the Encoder is closed. Fields must fit
+// in a single chunk along with the length and digest.
+func (e *Encoder) SetTrailer(key, value string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.usable(); err != nil {
+		return err
+	}
+	if e.trailer == nil {
+		return ErrNoTrailer
+	}
+
+	prev, ok := e.trailer.Fields[key]
+	e.trailer.Fields[key] = value
+	if e.trailer.len() > e.fw.header.maxPayload() {
+		if ok {
+			e.trailer.Fields[key] = prev
+		} else {
+			delete(e.trailer.Fields, key)
+		}
+		return ErrTrailerTooLarge
+	}
+	return nil
+}
+
+// WriteFrame writes a custom frame of the given type, which must be at
+// least FrameCustom, after flushing any buffered data. Its payload must fit
+// in a chunk. Custom frames are sealed and signed like chunks, and count as
+// chunks towards the next signature, but aren't indexed or deduplicated.
+func (e *Encoder) WriteFrame(t FrameType, payload []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.usable(); err != nil {
+		return err
+	}
+	if !t.custom() {
+		return ErrFrameType
+	}
+	if len(payload) > e.fw.header.maxPayload() {
+		return ErrFrameTooLarge
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+
+	if e.err = e.fw.WriteFrame(Frame{Type: t, Payload: payload}); e.err != nil {
+		return e.err
+	}
+	if e.signer != nil && e.signer.add(t, payload) {
+		if e.err = e.sign(false); e.err != nil {
+			return e.err
+		}
+	}
+	if e.heartbeatTimer != nil {
+		e.heartbeatTimer.Reset(e.heartbeatInterval)
+	}
+	return nil
+}
+
+// flush buffered data. Must be called with the lock
+// held.
+func (e *Encoder) flush() error {
+	if e.flushTimer != nil {
+		e.flushTimer.Stop()
+		e.flushTimer = nil
+	}
+
+	if len(e.ch) > 0 {
+		if err := e.encode(e.ch); err != nil {
+			return err
+		}
+		e.ch = e.ch[:0]
+	}
+	return e.drain(len(e.pending))
+}
+
+// cut returns how much of p belongs to the chunk
+// being buffered, and whether that completes it
+func (e *Encoder) cut(p []byte) (int, bool) {
+	if e.chunker != nil {
+		return e.chunker.cut(len(e.ch), p)
+	}
+	if m := e.size - len(e.ch); m <= len(p) {
+		return m, true
+	}
+	return len(p), false
+}
+
+// autoFlush once the flush interval has passed since
+// data was buffered. Errors surface on the next call.
+func (e *Encoder) autoFlush() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.usable() == nil && e.flush() == nil {
+		e.sign(false)
+	}
+}
+
+// heartbeat tells the other side the Encoder is still
+// alive, once it has been idle for the heartbeat
+// interval. Errors surface on the next call.
+func (e *Encoder) heartbeat() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.usable() != nil {
+		return
+	}
+	if e.err = e.fw.WriteFrame(Frame{Type: FrameHeartbeat}); e.err == nil {
+		e.heartbeatTimer.Reset(e.heartbeatInterval)
+	}
+}
+
+// encode a chunk into the stream, compressing it in
+// the background if the Encoder has concurrency
+func (e *Encoder) encode(chunk []byte) (err error) {
+	if e.concurrency > 1 && e.fw.codec != nil {
+		err = e.submit(chunk)
+	} else {
+		var compressed []byte
+		if compressed, err = e.fw.compress(chunk); err == nil {
+			err = e.writeChunk(chunk, compressed)
+		}
+	}
+	if err != nil {
+		e.err = err
+	}
+	return
+}
+
+// writeChunk to the stream, along with its compressed
+// form if there is one
+func (e *Encoder) writeChunk(chunk, compressed []byte) error {
+	if e.trailer != nil {
+		e.digest.Write(chunk)
+		e.trailer.Length += int64(len(chunk))
+	}
+	if e.indexed {
+		if err := e.fw.writeHeader(); err != nil {
+			return err
+		}
+		e.index.add(e.fw.offset, e.fw.index, len(chunk))
+	}
+	sequence := e.fw.sequence
+	var err error
+	if e.cache != nil {
+		err = e.writeDeduped(chunk, compressed)
+	} else {
+		err = e.fw.writeCompressed(0, chunk, compressed)
+	}
+	if err != nil {
+		return err
+	}
+	if e.parity != nil && e.parity.add(sequence, chunk) {
+		if err := e.writeParity(); err != nil {
+			return err
+		}
+	}
+	if e.signer != nil && e.signer.add(FrameData, chunk) {
+		if err := e.sign(false); err != nil {
+			return err
+		}
+	}
+	if e.heartbeatTimer != nil {
+		e.heartbeatTimer.Reset(e.heartbeatInterval)
+	}
+	return nil
+}
+
+// usable returns an error if the Encoder can't be
+// written to anymore
+func (e *Encoder) usable() error {
+	if e.closed {
+		return ErrClosedEncoder
+	}
+	return e.err
+}
+
+// close the Encoder to further calls. Must be called
+// with the lock held.
+func (e *Encoder) close() {
+	e.closed = true
+	if e.heartbeatTimer != nil {
+		e.heartbeatTimer.Stop()
+	}
 }
 
 // Close the Encoder. Flushes any unwritten data to an
-// incomplete chunk. This marks the end of the stream.
+// incomplete chunk, followed by a terminator marking
+// the end of the stream. Parity of the last group of
+// chunks, the Trailer and the final signature precede
+// the terminator, in that order, if the stream has
+// them. Indexed streams end with the index instead,
+// followed by the terminator and a footer locating the
+// index.
 func (e *Encoder) Close() error {
-	_, err := e.encode(e.ch.Len())
-	return err
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.usable(); err != nil {
+		return err
+	}
+	e.close()
+
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.writeParity(); err != nil {
+		return err
+	}
+	if e.trailer != nil {
+		e.digest.Sum(e.trailer.SHA256[:0])
+		payload := e.trailer.appendTo(nil)
+		if err := e.fw.WriteFrame(Frame{Type: FrameTrailer, Payload: payload}); err != nil {
+			return err
+		}
+		if e.signer != nil {
+			e.signer.add(FrameTrailer, payload)
+		}
+	}
+	if err := e.sign(true); err != nil {
+		return err
+	}
+	if e.indexed {
+		return e.index.writeTo(&e.fw)
+	}
+	return e.fw.WriteFrame(Frame{Type: FrameEnd})
+}
+
+// CloseWithError closes the Encoder after a failure of
+// whatever produced the data. Any unwritten data is
+// flushed, along with its parity, but the stream then
+// ends with the given error instead of a terminator,
+// which Decoders return as a *RemoteError. Neither a
+// Trailer nor an index is written.
+func (e *Encoder) CloseWithError(err error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.usable(); err != nil {
+		return err
+	}
+	e.close()
+
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.writeParity(); err != nil {
+		return err
+	}
+	if err := e.sign(false); err != nil {
+		return err
+	}
+	payload := newRemoteError(err).appendTo(nil, e.fw.header.maxPayload())
+	return e.fw.WriteFrame(Frame{Type: FrameError, Payload: payload})
 }
@@ -0,0 +1,677 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// FrameType distinguishes the frames making up a stream
+type FrameType byte
+
+const (
+	FrameData      FrameType = iota + 1 // a chunk of stream data
+	FrameEnd                            // the clean end of the stream
+	FrameClose                          // the end of a single channel's data
+	FrameAck                            // acknowledgement of data consumed
+	FrameIndex                          // part of the index of data frames
+	FrameTrailer                        // metadata describing the whole stream
+	FrameError                          // the failure of the producer
+	FrameHeartbeat                      // a sign of life from an idle producer
+	FrameParity                         // parity of a group of data frames
+	FrameRef                            // a reference to a chunk sent before
+	FrameSignature                      // a signature of the stream so far
+)
+
+// FrameCustom is the first of the frame types left to applications, which
+// write them with Encoder.WriteFrame and handle them with WithFrameHandler.
+// Decoders skip custom frames they have no handler for.
+const FrameCustom FrameType = 0x80
+
+// frameTypeNames of the types defined by the stream format
+var frameTypeNames = map[FrameType]string{
+	FrameData:      "data",
+	FrameEnd:       "end",
+	FrameClose:     "close",
+	FrameAck:       "ack",
+	FrameIndex:     "index",
+	FrameTrailer:   "trailer",
+	FrameError:     "error",
+	FrameHeartbeat: "heartbeat",
+	FrameParity:    "parity",
+	FrameRef:       "ref",
+	FrameSignature: "signature",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	if t.custom() {
+		return fmt.Sprintf("custom(%#x)", byte(t))
+	}
+	return fmt.Sprintf("unknown(%#x)", byte(t))
+}
+
+// chunk returns true for frames standing for a chunk of stream data
+func (t FrameType) chunk() bool {
+	return t == FrameData || t == FrameRef
+}
+
+// custom returns true for frame types left to applications
+func (t FrameType) custom() bool {
+	return t >= FrameCustom
+}
+
+// frame flags, marking how a frame's payload is stored
+const (
+	FrameCompressed byte = 1 << iota // payload compressed with the stream's codec
+)
+
+// varintSlot is the space reserved for each varint of a version 2 frame
+// header
+var varintSlot = binary.Size(uint64(0))
+
+// frameHeaderSize is the encoded length of a version 2 frame's type, flags
+// and length
+var frameHeaderSize = 2 + varintSlot
+
+// maxFrameHeaderLen is the longest compact frame header, with a channel
+const maxFrameHeaderLen = 2 + 2*binary.MaxVarintLen64
+
+// Frame is the unit of an encoded stream. Every frame is laid out as
+//
+//	type (1) | flags (1) | length (uvarint) | channel | sequence | payload | CRC-32C (4)
+//
+// where the channel is only present in streams with flagChannels set, as
+// another uvarint. The sequence number is only present on frames standing
+// for a chunk in streams with flagSequenced set, as yet another uvarint.
+// The checksum is only present in streams with flagChecksum set, and covers
+// everything before it. Flags mark how the payload is stored. Before
+// version 3, each uvarint was padded to a slot of 8 bytes. A Frame's length
+// is that of its Payload, which is unsealed but not decompressed.
+type Frame struct {
+	Type     FrameType
+	Flags    byte
+	Channel  uint64
+	Sequence uint64 // of chunk frames, with flagSequenced
+	Payload  []byte
+}
+
+// FrameWriter encodes frames onto a stream, preceded by the stream header
+type FrameWriter struct {
+	w           io.Writer
+	header      header
+	wroteHeader bool
+	codec       Codec
+	sealer      *sealer
+	index       int64  // index of the next frame
+	offset      int64  // stream offset of the next frame
+	sequence    uint64 // sequence number of the next data frame
+	buf         []byte
+	cbuf        []byte // compressed payload
+	ad          []byte // sealed metadata
+}
+
+// NewFrameWriter given a stream to write frames to, and the chunk size and
+// options recorded in the stream header. It is the layer beneath an
+// Encoder, which leaves cutting data into chunks to the caller, along with
+// any trailer, index, parity or signatures the options call for.
+func NewFrameWriter(s io.Writer, size int, opts ...Option) (*FrameWriter, error) {
+	fw, err := newFrameWriter(s, size, newConfig(opts))
+	if err != nil {
+		return nil, err
+	}
+	return &fw, nil
+}
+
+// newFrameWriter for a stream with the given chunk size and features
+func newFrameWriter(w io.Writer, size int, c config) (fw FrameWriter, err error) {
+	fw = FrameWriter{w: w, header: newHeader(size, c), codec: c.codec}
+	fw.sequence = fw.header.start.Sequence
+	if size <= 0 {
+		return fw, ErrInvalidSize
+	}
+	if err = c.checkLimits(fw.header); err != nil {
+		return
+	}
+	if c.aead != nil {
+		if fw.sealer, err = newSealer(c.aead, nil); err != nil {
+			return
+		}
+		fw.header.prefix = fw.sealer.prefix()
+	}
+	return
+}
+
+// WriteChunk writes a data frame holding the given chunk, which must be no
+// longer than the chunk size, compressing it if that makes it smaller.
+// Returns ErrFrameTooLarge if it's longer.
+func (fw *FrameWriter) WriteChunk(chunk []byte) error {
+	return fw.writeData(0, chunk)
+}
+
+// writeData frame holding the given chunk, compressing it if that makes it
+// smaller
+func (fw *FrameWriter) writeData(channel uint64, chunk []byte) error {
+	if len(chunk) > fw.header.maxPayload() {
+		return ErrFrameTooLarge
+	}
+	compressed, err := fw.compress(chunk)
+	if err != nil {
+		return err
+	}
+	return fw.writeCompressed(channel, chunk, compressed)
+}
+
+// compress a chunk with the stream's codec, if it has one. The result is
+// only valid until the next call.
+func (fw *FrameWriter) compress(chunk []byte) (compressed []byte, err error) {
+	if fw.codec == nil {
+		return nil, nil
+	}
+	fw.cbuf, err = fw.codec.Compress(fw.cbuf[:0], chunk)
+	return fw.cbuf, err
+}
+
+// writeCompressed data frame holding the given chunk, or its compressed
+// form if there is one and it's smaller
+func (fw *FrameWriter) writeCompressed(channel uint64, chunk, compressed []byte) error {
+	f := Frame{Type: FrameData, Channel: channel, Payload: chunk}
+	if compressed != nil && len(compressed) < len(chunk) {
+		f.Flags |= FrameCompressed
+		f.Payload = compressed
+	}
+	return fw.WriteFrame(f)
+}
+
+// writeHeader of the stream, unless it's already written
+func (fw *FrameWriter) writeHeader() error {
+	if fw.wroteHeader {
+		return nil
+	}
+	if err := fw.header.writeTo(fw.w); err != nil {
+		return err
+	}
+	if fw.sealer != nil {
+		fw.sealer.authenticate(fw.header)
+	}
+	fw.wroteHeader = true
+	fw.offset = int64(fw.header.len())
+	return nil
+}
+
+// WriteFrame encodes the given frame with a single Write, writing the
+// stream header first if necessary. The frame's channel is only written
+// to streams with channels, and data frames are numbered in order in
+// sequenced streams, whatever their Sequence. Returns ErrFrameTooLarge if
+// the payload is longer than a Decoder accepts for the frame's type, which
+// is the chunk size for most.
+func (fw *FrameWriter) WriteFrame(f Frame) error {
+	if len(f.Payload) > fw.maxPayload(f.Type) {
+		return ErrFrameTooLarge
+	}
+	if err := fw.writeHeader(); err != nil {
+		return err
+	}
+
+	sz := len(f.Payload)
+	if fw.sealer != nil {
+		sz += fw.sealer.aead.Overhead()
+	}
+
+	b := append(fw.buf[:0], byte(f.Type), f.Flags)
+	var lenEnd int
+	if fw.header.version < compactVersion {
+		b = append(b, make([]byte, fw.header.frameHeaderLen()-2)...)
+		binary.PutUvarint(b[2:], uint64(sz))
+		if fw.header.has(flagChannels) {
+			binary.PutUvarint(b[frameHeaderSize:], f.Channel)
+		}
+		lenEnd = frameHeaderSize
+	} else {
+		b = binary.AppendUvarint(b, uint64(sz))
+		lenEnd = len(b)
+		if fw.header.has(flagChannels) {
+			b = binary.AppendUvarint(b, f.Channel)
+		}
+		if f.Type.chunk() && fw.header.has(flagSequenced) {
+			b = binary.AppendUvarint(b, fw.sequence)
+			fw.sequence++
+		}
+	}
+
+	// Sealing authenticates the frame's metadata along with the payload
+	if fw.sealer != nil {
+		var err error
+		fw.ad = sealedMetadata(fw.ad, fw.sealer.header, b, lenEnd)
+		if b, err = fw.sealer.seal(b, f.Payload, fw.ad, fw.index); err != nil {
+			return err
+		}
+	} else {
+		b = append(b, f.Payload...)
+	}
+
+	if fw.header.has(flagChecksum) {
+		b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+	}
+
+	fw.buf = b
+	fw.index++
+	fw.offset += int64(len(b))
+	_, err := fw.w.Write(b)
+	return err
+}
+
+// maxPayload is the largest payload of a frame of the given type, before
+// sealing. Parity and signatures may be longer than a chunk, so
+// FrameReader.maxPayload allows for them.
+func (fw *FrameWriter) maxPayload(t FrameType) int {
+	switch n := fw.header.maxPayload(); t {
+	case FrameParity:
+		return n + parityOverhead
+	case FrameSignature:
+		return max(n, maxSignaturePayload)
+	default:
+		return n
+	}
+}
+
+// FrameReader decodes frames from a stream, after reading its header
+type FrameReader struct {
+	r         io.Reader
+	br        byteReader // r, buffered unless it reads bytes itself
+	config    config     // requirements of the stream, given NewFrameReader
+	header    header
+	headerErr error // from reading the header, once it's read
+	started   bool  // whether the header has been read
+	codec     Codec
+	sealer    *sealer
+
+	index    int64  // index of the current frame
+	chunk    int64  // index of the current frame among chunks
+	chunks   int64  // chunks read before the next frame
+	offset   int64  // stream offset of the current frame
+	next     int64  // stream offset of the next frame
+	sequence uint64 // sequence number expected of the next data frame
+	gaps     bool   // whether data frames may be missing, as with datagrams
+	buf      []byte
+	dbuf     []byte // decompressed payload
+	ad       []byte // sealed metadata
+}
+
+// NewFrameReader given a stream of frames. Its header is read along with
+// the first frame, and must satisfy the given options as with NewDecoder.
+// It is the layer beneath a Decoder, which leaves verifying the stream
+// against any trailer or signatures to the caller.
+func NewFrameReader(s io.Reader, opts ...Option) *FrameReader {
+	return &FrameReader{r: s, config: newConfig(opts)}
+}
+
+// Size of the stream's chunks, once its header has been read
+func (fr *FrameReader) Size() int {
+	return fr.header.size
+}
+
+// Offset of the frame last read within the encoded stream
+func (fr *FrameReader) Offset() int64 {
+	return fr.offset
+}
+
+// readHeader from the start of the stream, and check that it satisfies the
+// given requirements
+func (fr *FrameReader) readHeader(c config) error {
+	fr.started = true
+	fr.headerErr = fr.decodeHeader(c)
+	return fr.headerErr
+}
+
+// decodeHeader read from the start of the stream
+func (fr *FrameReader) decodeHeader(c config) (err error) {
+	fr.br = buffered(fr.r)
+	if fr.header, err = readHeader(fr.br); err != nil {
+		return
+	}
+	fr.index, fr.next = -1, int64(fr.header.len())
+	fr.sequence = fr.header.start.Sequence
+
+	if err = c.checkLimits(fr.header); err != nil {
+		return
+	}
+	if c.checksum && !fr.header.has(flagChecksum) {
+		return ErrNoChecksum
+	}
+	if c.trailer && !fr.header.has(flagTrailer) {
+		return ErrNoTrailer
+	}
+	if c.parity > 0 && !fr.header.has(flagParity) {
+		return ErrNoParity
+	}
+	if c.publicKey != nil && !fr.header.has(flagSigned) {
+		return ErrNotSigned
+	}
+	if c.sequenced && !fr.header.has(flagSequenced) {
+		return ErrNotSequenced
+	}
+	if c.resume != nil && fr.header.start != *c.resume {
+		return ErrResumeMismatch
+	}
+	if fr.header.has(flagCompressed) {
+		fr.codec, _ = lookupCodec(fr.header.codec)
+	}
+
+	switch sealed := fr.header.has(flagSealed); {
+	case sealed && c.aead == nil:
+		return ErrNoKey
+	case !sealed && c.aead != nil:
+		return ErrNotSealed
+	case sealed:
+		if fr.sealer, err = newSealer(c.aead, fr.header.prefix); err == nil {
+			fr.sealer.authenticate(fr.header)
+		}
+	}
+	return
+}
+
+// seek to the frame with the given index and chunk index, read from r at
+// the given stream offset
+func (fr *FrameReader) seek(r io.Reader, offset, index, chunk int64) {
+	fr.r, fr.br = r, buffered(r)
+	fr.next, fr.index, fr.chunks = offset, index-1, chunk
+}
+
+// ReadFrame decodes the next frame of the stream, after reading the header
+// if it hasn't been yet. The frame's payload is only valid until the next
+// call. It returns io.EOF only if the stream ends cleanly between two
+// frames, which may be past its end frame.
+func (fr *FrameReader) ReadFrame() (f Frame, err error) {
+	if !fr.started {
+		fr.readHeader(fr.config)
+	}
+	if fr.headerErr != nil {
+		return f, fr.headerErr
+	}
+
+	fr.index, fr.chunk, fr.offset = fr.index+1, fr.chunks, fr.next
+	if cap(fr.buf) < maxFrameHeaderLen {
+		fr.buf = make([]byte, 0, maxFrameHeaderLen+minPayload+checksumSize)
+	}
+
+	var sz uint64
+	var hdrLen, lenEnd int
+	if fr.header.version < compactVersion {
+		sz, hdrLen, err = fr.readSlottedHeader(&f)
+		lenEnd = frameHeaderSize
+	} else {
+		sz, hdrLen, lenEnd, err = fr.readCompactHeader(&f)
+	}
+	if err != nil {
+		return
+	}
+	if sz > uint64(fr.maxPayload()) {
+		return f, fr.corrupt()
+	}
+
+	// Read the payload, and checksum if present, in one go
+	n := hdrLen + int(sz)
+	framed := n
+	if fr.header.has(flagChecksum) {
+		framed += checksumSize
+	}
+	if err = fr.readPayload(hdrLen, framed); err != nil {
+		return
+	}
+
+	if fr.header.has(flagChecksum) {
+		if crc32.Checksum(fr.buf[:n], castagnoli) != binary.BigEndian.Uint32(fr.buf[n:]) {
+			return f, fr.corrupt()
+		}
+	}
+
+	f.Type, f.Flags = FrameType(fr.buf[0]), fr.buf[1]
+	f.Payload = fr.buf[hdrLen:n]
+	fr.next += int64(framed)
+	if f.Type.chunk() {
+		fr.chunks++
+	}
+
+	if fr.sealer != nil {
+		fr.ad = sealedMetadata(fr.ad, fr.sealer.header, fr.buf[:hdrLen], lenEnd)
+		if f.Payload, err = fr.sealer.open(f.Payload, fr.ad, fr.index); err != nil {
+			return f, fr.corrupt()
+		}
+	}
+	return
+}
+
+// readPayload of a frame, along with its checksum if present, into the
+// buffer after its header, until the buffer holds framed bytes. The buffer
+// grows only as the payload arrives, so a frame can't make it grow much
+// larger than what's actually read.
+func (fr *FrameReader) readPayload(hdrLen, framed int) error {
+	fr.buf = fr.buf[:hdrLen]
+	for len(fr.buf) < framed {
+		if len(fr.buf) == cap(fr.buf) {
+			fr.buf = append(fr.buf, 0)[:len(fr.buf)]
+		}
+		n := len(fr.buf)
+		m, err := io.ReadFull(fr.br, fr.buf[n:min(framed, cap(fr.buf))])
+		fr.buf = fr.buf[:n+m]
+		if err != nil {
+			return unexpected(err)
+		}
+	}
+	return nil
+}
+
+// readSlottedHeader of a version 2 frame, with each varint padded to a
+// fixed slot, into the start of the buffer. Returns the payload length and
+// header length.
+func (fr *FrameReader) readSlottedHeader(f *Frame) (sz uint64, hdrLen int, err error) {
+	hdrLen = fr.header.frameHeaderLen()
+	hdr := fr.buf[:hdrLen]
+	if _, err = io.ReadFull(fr.br, hdr); err != nil {
+		return
+	}
+
+	sz, m := binary.Uvarint(hdr[2:])
+	if m <= 0 {
+		return sz, hdrLen, fr.corrupt()
+	}
+	if fr.header.has(flagChannels) {
+		if f.Channel, m = binary.Uvarint(hdr[frameHeaderSize:]); m <= 0 {
+			return sz, hdrLen, fr.corrupt()
+		}
+	}
+	return
+}
+
+// readCompactHeader of a frame byte by byte into the start of the buffer.
+// Returns the payload length, the header length and where the length ends.
+func (fr *FrameReader) readCompactHeader(f *Frame) (sz uint64, hdrLen, lenEnd int, err error) {
+	hdr := fr.buf[:0]
+	for len(hdr) < 2 {
+		var c byte
+		if c, err = fr.br.ReadByte(); err != nil {
+			if len(hdr) > 0 {
+				err = unexpected(err)
+			}
+			return
+		}
+		hdr = append(hdr, c)
+	}
+
+	if sz, hdr, err = fr.readUvarint(hdr); err != nil {
+		return
+	}
+	lenEnd = len(hdr)
+	if fr.header.has(flagChannels) {
+		if f.Channel, hdr, err = fr.readUvarint(hdr); err != nil {
+			return
+		}
+	}
+
+	// Chunks must follow each other without gaps, unless lost ones are
+	// expected
+	if FrameType(hdr[0]).chunk() && fr.header.has(flagSequenced) {
+		if f.Sequence, hdr, err = fr.readUvarint(hdr); err != nil {
+			return
+		}
+		if f.Sequence != fr.sequence && !fr.gaps {
+			return sz, len(hdr), lenEnd, fr.corrupt()
+		}
+		fr.sequence = f.Sequence + 1
+	}
+	return sz, len(hdr), lenEnd, nil
+}
+
+// readUvarint of a compact frame header byte by byte, appending its
+// encoding to the header
+func (fr *FrameReader) readUvarint(hdr []byte) (uint64, []byte, error) {
+	start := len(hdr)
+	for len(hdr)-start < binary.MaxVarintLen64 {
+		c, err := fr.br.ReadByte()
+		if err != nil {
+			return 0, hdr, unexpected(err)
+		}
+		hdr = append(hdr, c)
+
+		if c < 0x80 {
+			v, n := binary.Uvarint(hdr[start:])
+			if n <= 0 {
+				break
+			}
+			return v, hdr, nil
+		}
+	}
+	return 0, hdr, fr.corrupt()
+}
+
+// Data returns the chunk held by a data frame, decompressing it if
+// necessary. The chunk is only valid until the next call.
+func (fr *FrameReader) Data(f Frame) (chunk []byte, err error) {
+	switch chunk, err = decodePayload(fr.codec, fr.dbuf[:0], f, fr.header.size); {
+	case err == errCorruptPayload:
+		return nil, fr.corrupt()
+	case err == nil && f.Flags == FrameCompressed:
+		fr.dbuf = chunk
+	}
+	return
+}
+
+// decodePayload of a data frame into the chunk it holds, decompressing it
+// into dst if necessary
+func decodePayload(codec Codec, dst []byte, f Frame, limit int) ([]byte, error) {
+	switch f.Flags {
+	case 0:
+		return f.Payload, nil
+	case FrameCompressed:
+		if codec == nil {
+			return nil, ErrIncompatible
+		}
+		chunk, err := codec.Decompress(dst, f.Payload, limit)
+		if err != nil {
+			return nil, errCorruptPayload
+		}
+		return chunk, nil
+	default:
+		return nil, ErrIncompatible
+	}
+}
+
+// maxPayload is the largest encoded payload a frame of the stream may have
+func (fr *FrameReader) maxPayload() int {
+	n := fr.header.maxPayload()
+	if fr.header.has(flagParity) {
+		n += parityOverhead
+	}
+	if fr.header.has(flagSigned) && n < maxSignaturePayload {
+		n = maxSignaturePayload
+	}
+	if fr.sealer != nil {
+		n += fr.sealer.aead.Overhead()
+	}
+	return n
+}
+
+// corrupt builds an error describing the frame last read
+func (fr *FrameReader) corrupt() error {
+	return &CorruptionError{Frame: fr.index, Chunk: fr.chunk, Offset: fr.offset}
+}
+
+// errCorruptPayload reports a payload which failed to decode, to be turned
+// into a CorruptionError describing its frame
+var errCorruptPayload = errors.New("corrupt payload")
+
+// sealedMetadata picks out the parts of an encoded frame header which are
+// authenticated when sealing: its type, flags, and channel and sequence
+// number, which follow the length ending at lenEnd. They follow the stream
+// header, if it's authenticated too, and are appended to dst if they aren't
+// contiguous.
+func sealedMetadata(dst, streamHeader, hdr []byte, lenEnd int) []byte {
+	if streamHeader == nil && lenEnd == len(hdr) {
+		return hdr[:2]
+	}
+	dst = append(append(dst[:0], streamHeader...), hdr[:2]...)
+	return append(dst, hdr[lenEnd:]...)
+}
+
+// readPeer decodes the incoming stream of a Mux or Session, which must have
+// the given flags, calling started with its header and then handle with
+// every frame up to the end. Returns io.EOF once the other side ended its
+// stream, or else the error which broke it. A broken stream can't be
+// recovered from, so rw is then closed to stop the other side from carrying
+// on writing into it.
+func readPeer(rw io.ReadWriter, c config, flags uint32, started func(header), handle func(*FrameReader, Frame) error) error {
+	fr := FrameReader{r: rw}
+	err := fr.readHeader(c)
+	if err == nil && !fr.header.has(flags) {
+		err = ErrIncompatible
+	}
+	if err == nil && started != nil {
+		started(fr.header)
+	}
+
+	for err == nil {
+		var f Frame
+		switch f, err = fr.ReadFrame(); {
+		case err != nil:
+			err = unexpected(err)
+		case f.Type == FrameEnd:
+			err = io.EOF
+		default:
+			err = handle(&fr, f)
+		}
+	}
+
+	if closer, ok := rw.(io.Closer); ok && err != io.EOF {
+		closer.Close()
+	}
+	return err
+}
+
+// byteReader reads either blocks or single bytes
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// buffered returns r as a byteReader, adding a buffer if necessary
+func buffered(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// unexpected converts an io.EOF in the middle of a frame to an
+// io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// mark is a custom frame type for tests
+const mark = FrameCustom + 1
+
+func TestFrames(t *testing.T) {
+	Convey("Given an encoded stream", t, func() {
+		in := randomBytes(CHUNK_SIZE*2 + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithChecksum(), WithCompression(Flate), WithTrailer())
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a FrameReader should read each of its frames", func() {
+			fr := NewFrameReader(&s, WithChecksum())
+			var types []FrameType
+			var out []byte
+			for {
+				f, err := fr.ReadFrame()
+				if err == io.EOF {
+					break
+				}
+				So(err, ShouldBeNil)
+				types = append(types, f.Type)
+
+				if f.Type == FrameData {
+					So(f.Flags, ShouldEqual, 0)
+					So(f.Payload, ShouldHaveLength, min(CHUNK_SIZE, len(in)-len(out)))
+					chunk, err := fr.Data(f)
+					So(err, ShouldBeNil)
+					out = append(out, chunk...)
+				}
+			}
+			So(types, ShouldResemble, []FrameType{FrameData, FrameData, FrameData, FrameTrailer, FrameEnd})
+			So(out, ShouldResemble, in)
+			So(fr.Size(), ShouldEqual, CHUNK_SIZE)
+		})
+
+		Convey("Then a FrameReader should check its requirements", func() {
+			_, err := NewFrameReader(&s, WithAEAD(newAEAD(testKey))).ReadFrame()
+			So(err, ShouldEqual, ErrNotSealed)
+		})
+	})
+
+	Convey("Given frames written by a FrameWriter", t, func() {
+		in := randomBytes(CHUNK_SIZE + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		fw, err := NewFrameWriter(&s, CHUNK_SIZE, WithSequence(), WithCompression(Flate))
+		So(err, ShouldBeNil)
+		So(fw.WriteChunk(in[:CHUNK_SIZE]), ShouldBeNil)
+		So(fw.WriteChunk(in[CHUNK_SIZE:]), ShouldBeNil)
+		So(fw.WriteFrame(Frame{Type: FrameEnd}), ShouldBeNil)
+
+		Convey("Then chunks and frames larger than the chunk size should be refused", func() {
+			So(fw.WriteChunk(make([]byte, CHUNK_SIZE+1)), ShouldEqual, ErrFrameTooLarge)
+			So(fw.WriteFrame(Frame{Type: mark, Payload: make([]byte, CHUNK_SIZE+1)}), ShouldEqual, ErrFrameTooLarge)
+		})
+
+		Convey("Then a Decoder should read them as a stream", func() {
+			d := NewDecoder(&s, WithSequence())
+			out, err := ioutil.ReadAll(d)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+			So(d.Checkpoint(), ShouldResemble, Checkpoint{Sequence: 2, Offset: int64(len(in))})
+		})
+	})
+}
+
+func TestCustomFrames(t *testing.T) {
+	// marks records each mark along with how much data came before it
+	type marks map[int]string
+	handler := func(ms marks, out *bytes.Buffer) Option {
+		return WithFrameHandler(mark, func(f Frame) error {
+			ms[out.Len()] = string(f.Payload)
+			return nil
+		})
+	}
+
+	Convey("Given a stream with custom frames between its data", t, func() {
+		in := randomBytes(CHUNK_SIZE*3 + CHUNK_SIZE/2)
+		pub, key, _ := ed25519.GenerateKey(nil)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithSigning(key, 2), WithCompression(Flate))
+		e.Write(in[:CHUNK_SIZE/2])
+		So(e.WriteFrame(mark, []byte("first")), ShouldBeNil)
+		e.Write(in[CHUNK_SIZE/2 : CHUNK_SIZE*3])
+		So(e.WriteFrame(mark, []byte("second")), ShouldBeNil)
+		e.Write(in[CHUNK_SIZE*3:])
+		So(e.Close(), ShouldBeNil)
+		enc := s.Bytes()
+		want := marks{CHUNK_SIZE / 2: "first", CHUNK_SIZE * 3: "second"}
+
+		Convey("Then a Decoder should hand them to the handler in order", func() {
+			ms, out := marks{}, new(bytes.Buffer)
+			_, err := NewDecoder(bytes.NewReader(enc), handler(ms, out)).WriteTo(out)
+			So(err, ShouldBeNil)
+			So(out.Bytes(), ShouldResemble, in)
+			So(ms, ShouldResemble, want)
+		})
+
+		Convey("Then they should be verified before being handled", func() {
+			ms, out := marks{}, new(bytes.Buffer)
+			_, err := NewDecoder(bytes.NewReader(enc), handler(ms, out), WithVerification(pub), WithConcurrency(4)).WriteTo(out)
+			So(err, ShouldBeNil)
+			So(out.Bytes(), ShouldResemble, in)
+			So(ms, ShouldResemble, want)
+		})
+
+		Convey("Then a tampered custom frame shouldn't be handled", func() {
+			enc[bytes.Index(enc, []byte("second"))] ^= 1
+			ms, out := marks{}, new(bytes.Buffer)
+			_, err := NewDecoder(bytes.NewReader(enc), handler(ms, out), WithVerification(pub)).WriteTo(out)
+			So(err, ShouldEqual, ErrSignature)
+			So(ms, ShouldResemble, marks{CHUNK_SIZE / 2: "first"})
+		})
+
+		Convey("Then a Decoder without a handler should skip them", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc)))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then an error from the handler should end decoding", func() {
+			failed := errors.New("failed")
+			d := NewDecoder(bytes.NewReader(enc), WithFrameHandler(mark, func(Frame) error { return failed }))
+			out, err := ioutil.ReadAll(d)
+			So(err, ShouldEqual, failed)
+			So(out, ShouldResemble, in[:CHUNK_SIZE/2])
+		})
+	})
+
+	Convey("Given an Encoder", t, func() {
+		e := NewEncoder(ioutil.Discard, CHUNK_SIZE)
+
+		Convey("Then it should refuse to write reserved frame types", func() {
+			So(e.WriteFrame(FrameEnd, nil), ShouldEqual, ErrFrameType)
+		})
+
+		Convey("Then it should refuse custom frames larger than a chunk", func() {
+			So(e.WriteFrame(mark, make([]byte, CHUNK_SIZE+1)), ShouldEqual, ErrFrameTooLarge)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// fuzzOptions picks options from the bits of flags
+func fuzzOptions(flags uint8, size int) []Option {
+	var opts []Option
+	if flags&1 != 0 {
+		opts = append(opts, WithChecksum())
+	}
+	if flags&2 != 0 {
+		opts = append(opts, WithCompression(Flate))
+	}
+	if flags&4 != 0 {
+		opts = append(opts, WithTrailer())
+	}
+	if flags&8 != 0 {
+		opts = append(opts, WithSequence())
+	}
+	if flags&16 != 0 {
+		opts = append(opts, WithIndex())
+	}
+	if flags&32 != 0 {
+		opts = append(opts, WithParity(3))
+	}
+	if flags&64 != 0 && size >= 16 {
+		opts = append(opts, WithContentDefinedChunking(size/8, size/2))
+	}
+	if flags&128 != 0 {
+		opts = append(opts, WithDeduplication(size*4))
+	}
+	return opts
+}
+
+// fuzzSeeds are streams of a few chunks encoded with various options
+func fuzzSeeds() (seeds [][]byte) {
+	in := append(randomBytes(200), bytes.Repeat([]byte("moreio"), 50)...)
+	for _, flags := range []uint8{0, 1, 2, 7, 8, 27, 42, 255} {
+		var s bytes.Buffer
+		e := NewEncoder(&s, 128, fuzzOptions(flags, 128)...)
+		e.Write(in)
+		e.Close()
+		seeds = append(seeds, s.Bytes())
+	}
+	return
+}
+
+// decodeAll of a stream, with the error described so that errors of
+// different decodes compare equal
+func decodeAll(r io.Reader, opts ...Option) ([]byte, string) {
+	out, err := ioutil.ReadAll(NewDecoder(r, opts...))
+	return out, fmt.Sprint(err)
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Add([]byte(magic))
+
+	f.Fuzz(func(t *testing.T, enc []byte) {
+		limit := WithMaxChunkSize(1 << 16)
+		out, err := decodeAll(bytes.NewReader(enc), limit)
+
+		// Short reads of the source mustn't change what's decoded
+		sources := map[string]io.Reader{
+			"one byte": iotest.OneByteReader(bytes.NewReader(enc)),
+			"half":     iotest.HalfReader(bytes.NewReader(enc)),
+			"data err": iotest.DataErrReader(bytes.NewReader(enc)),
+		}
+		for name, r := range sources {
+			o, e := decodeAll(r, limit)
+			if !bytes.Equal(o, out) || e != err {
+				t.Fatalf("%s reads decoded %d bytes with %s, want %d bytes with %s", name, len(o), e, len(out), err)
+			}
+		}
+
+		o, e := decodeAll(bytes.NewReader(enc), limit, WithConcurrency(4))
+		if !bytes.Equal(o, out) || e != err {
+			t.Fatalf("concurrency decoded %d bytes with %s, want %d bytes with %s", len(o), e, len(out), err)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("moreio"), uint16(4), uint8(0))
+	f.Add(randomBytes(1000), uint16(100), uint8(7))
+	f.Add(bytes.Repeat([]byte("moreio"), 100), uint16(64), uint8(255))
+	f.Add([]byte{}, uint16(1), uint8(31))
+
+	f.Fuzz(func(t *testing.T, in []byte, size uint16, flags uint8) {
+		sz := int(size)%4096 + 1
+		var s bytes.Buffer
+		e := NewEncoder(&s, sz, fuzzOptions(flags, sz)...)
+
+		// Write in pieces, so chunks are cut across writes
+		for p := in; len(p) > 0; {
+			n := min(len(p), sz/2+1)
+			if _, err := e.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := ioutil.ReadAll(NewDecoder(iotest.HalfReader(&s)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatalf("decoded %d bytes, want %d", len(out), len(in))
+		}
+	})
+}
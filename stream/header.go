@@ -0,0 +1,345 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// magic identifies the start of an encoded stream
+const magic = "\x89MIO"
+
+// version of the stream format written by Encoders. Version 2 replaced
+// inferring the end from a short chunk with typed frames and a terminator.
+// Version 3 writes only the bytes each varint of a frame header needs.
+// Version 4 authenticates the header along with every sealed frame.
+const version = 4
+
+// minVersion is the oldest stream format Decoders still read
+const minVersion = 2
+
+// compactVersion is the first version with compact frame headers
+const compactVersion = 3
+
+// sealedHeaderVersion is the first version whose sealed frames authenticate
+// the stream header
+const sealedHeaderVersion = 4
+
+// header flags, recording which optional features a stream uses
+const (
+	flagChecksum uint32 = 1 << iota
+	flagCompressed
+	flagSealed
+	flagChannels
+	flagWindowed
+	flagMessages
+	flagIndexed
+	flagTrailer
+	flagSequenced
+	flagParity
+	flagDeduped
+	flagSigned
+
+	knownFlags = flagChecksum | flagCompressed | flagSealed | flagChannels |
+		flagWindowed | flagMessages | flagIndexed | flagTrailer | flagSequenced |
+		flagParity | flagDeduped | flagSigned
+)
+
+// minPayload is the smallest payload limit of any stream. Frames other
+// than data may need this much room even with tiny chunks.
+const minPayload = 64
+
+// DefaultMaxChunkSize is the largest chunk size Encoders and Decoders
+// accept, unless given WithMaxChunkSize
+const DefaultMaxChunkSize = 16 << 20
+
+// maxHeldChunks is how many chunks of the largest size accepted a Decoder
+// may have to hold at once, in its deduplication cache or until a signature
+// covers them
+const maxHeldChunks = 64
+
+// headerSize is the encoded length of the fixed part of a header: magic,
+// version, flags and chunk size. Some flags append fields of their own.
+const headerSize = len(magic) + 1 + 4 + 4
+
+var (
+	ErrNotStream    = errors.New("input is not an encoded stream")
+	ErrVersion      = errors.New("unsupported stream version")
+	ErrIncompatible = errors.New("stream uses unsupported features")
+	ErrNoChecksum   = errors.New("stream has no checksums")
+	ErrUnknownCodec = errors.New("stream compressed with unregistered codec")
+	ErrMemoryLimit  = errors.New("stream would hold more chunks than allowed")
+)
+
+// ChunkSizeError reports a chunk size exceeding the maximum
+type ChunkSizeError struct {
+	Size int // chunk size of the stream
+	Max  int // maximum chunk size
+}
+
+func (e *ChunkSizeError) Error() string {
+	return fmt.Sprintf("chunk size of %d bytes exceeds maximum of %d", e.Size, e.Max)
+}
+
+// header describes an encoded stream. It is written once, before the
+// first frame.
+type header struct {
+	version byte
+	flags   uint32
+	size    int
+	codec   byte       // ID of the compression codec, with flagCompressed
+	prefix  []byte     // nonce prefix, with flagSealed
+	window  int        // unacknowledged bytes allowed, with flagWindowed
+	start   Checkpoint // where the stream starts, with flagSequenced
+	parity  int        // data frames per parity frame, with flagParity
+	cache   int        // bytes of chunks cached, with flagDeduped
+
+	signEvery int // chunks per signature, with flagSigned
+}
+
+// newHeader describes a stream of the given chunk size and features
+func newHeader(size int, c config) header {
+	h := header{version: version, size: size}
+	if c.checksum {
+		h.flags |= flagChecksum
+	}
+	if c.codec != nil {
+		h.flags |= flagCompressed
+		h.codec = c.codec.ID()
+	}
+	if c.aead != nil {
+		h.flags |= flagSealed
+	}
+	if c.channels {
+		h.flags |= flagChannels
+	}
+	if c.window > 0 {
+		h.flags |= flagWindowed
+		h.window = c.window
+	}
+	if c.messages {
+		h.flags |= flagMessages
+	}
+	if c.index {
+		h.flags |= flagIndexed
+	}
+	if c.trailer {
+		h.flags |= flagTrailer
+	}
+	if c.sequenced {
+		h.flags |= flagSequenced
+		if c.resume != nil {
+			h.start = *c.resume
+		}
+	}
+	if c.parity > 0 {
+		h.flags |= flagParity
+		h.parity = c.parity
+	}
+	if c.dedup > 0 {
+		h.flags |= flagDeduped
+		h.cache = c.dedup
+	}
+	if c.privateKey != nil {
+		h.flags |= flagSigned
+		h.signEvery = c.signEvery
+	}
+	return h
+}
+
+// has returns true if all of the given flags are set
+func (h header) has(flags uint32) bool {
+	return h.flags&flags == flags
+}
+
+// len is the encoded length of the header
+func (h header) len() int {
+	n := headerSize
+	if h.has(flagCompressed) {
+		n++
+	}
+	if h.has(flagSealed) {
+		n += 1 + len(h.prefix)
+	}
+	if h.has(flagWindowed) {
+		n += 4
+	}
+	if h.has(flagSequenced) {
+		n += 16
+	}
+	if h.has(flagParity) {
+		n += 4
+	}
+	if h.has(flagDeduped) {
+		n += 4
+	}
+	if h.has(flagSigned) {
+		n += 4
+	}
+	return n
+}
+
+// maxPayload is the largest unsealed payload of any frame in the stream
+func (h header) maxPayload() int {
+	if h.size < minPayload {
+		return minPayload
+	}
+	return h.size
+}
+
+// frameHeaderLen is the encoded length of each frame header in a version 2
+// stream
+func (h header) frameHeaderLen() int {
+	if h.has(flagChannels) {
+		return frameHeaderSize + varintSlot
+	}
+	return frameHeaderSize
+}
+
+// writeTo the given stream
+func (h header) writeTo(w io.Writer) error {
+	_, err := w.Write(h.bytes())
+	return err
+}
+
+// bytes of the encoded header
+func (h header) bytes() []byte {
+	b := make([]byte, headerSize, h.len())
+	n := copy(b, magic)
+	b[n] = h.version
+	binary.BigEndian.PutUint32(b[n+1:], h.flags)
+	binary.BigEndian.PutUint32(b[n+5:], uint32(h.size))
+
+	if h.has(flagCompressed) {
+		b = append(b, h.codec)
+	}
+	if h.has(flagSealed) {
+		b = append(b, byte(len(h.prefix)))
+		b = append(b, h.prefix...)
+	}
+	if h.has(flagWindowed) {
+		b = binary.BigEndian.AppendUint32(b, uint32(h.window))
+	}
+	if h.has(flagSequenced) {
+		b = binary.BigEndian.AppendUint64(b, h.start.Sequence)
+		b = binary.BigEndian.AppendUint64(b, uint64(h.start.Offset))
+	}
+	if h.has(flagParity) {
+		b = binary.BigEndian.AppendUint32(b, uint32(h.parity))
+	}
+	if h.has(flagDeduped) {
+		b = binary.BigEndian.AppendUint32(b, uint32(h.cache))
+	}
+	if h.has(flagSigned) {
+		b = binary.BigEndian.AppendUint32(b, uint32(h.signEvery))
+	}
+	return b
+}
+
+// readHeader from the start of a stream, rejecting anything this package
+// can't decode
+func readHeader(r io.Reader) (h header, err error) {
+	var b [headerSize]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrNotStream
+		}
+		return
+	}
+
+	n := len(magic)
+	if !bytes.Equal(b[:n], []byte(magic)) {
+		return h, ErrNotStream
+	}
+
+	h.version = b[n]
+	h.flags = binary.BigEndian.Uint32(b[n+1:])
+	h.size = int(binary.BigEndian.Uint32(b[n+5:]))
+
+	switch {
+	case h.version < minVersion || h.version > version:
+		return h, ErrVersion
+	case h.flags&^knownFlags != 0:
+		return h, ErrIncompatible
+	case h.size <= 0:
+		return h, ErrNotStream
+	}
+
+	// Read the fields of any flags which have them
+	var field [1]byte
+	if h.has(flagCompressed) {
+		if _, err = io.ReadFull(r, field[:]); err != nil {
+			return h, unexpected(err)
+		}
+		h.codec = field[0]
+		if _, ok := lookupCodec(h.codec); !ok {
+			return h, ErrUnknownCodec
+		}
+	}
+	if h.has(flagSealed) {
+		if _, err = io.ReadFull(r, field[:]); err != nil {
+			return h, unexpected(err)
+		}
+		h.prefix = make([]byte, field[0])
+		if _, err = io.ReadFull(r, h.prefix); err != nil {
+			return h, unexpected(err)
+		}
+	}
+	if h.has(flagWindowed) {
+		var window [4]byte
+		if _, err = io.ReadFull(r, window[:]); err != nil {
+			return h, unexpected(err)
+		}
+		if h.window = int(binary.BigEndian.Uint32(window[:])); h.window == 0 {
+			return h, ErrNotStream
+		}
+	}
+	if h.has(flagSequenced) {
+		// Sequence numbers came along with compact frame headers
+		if h.version < compactVersion {
+			return h, ErrIncompatible
+		}
+		var start [16]byte
+		if _, err = io.ReadFull(r, start[:]); err != nil {
+			return h, unexpected(err)
+		}
+		h.start.Sequence = binary.BigEndian.Uint64(start[:])
+		if h.start.Offset = int64(binary.BigEndian.Uint64(start[8:])); h.start.Offset < 0 {
+			return h, ErrNotStream
+		}
+	}
+	if h.has(flagParity) {
+		// Parity frames are matched to data frames by sequence number
+		if !h.has(flagSequenced) {
+			return h, ErrIncompatible
+		}
+		var parity [4]byte
+		if _, err = io.ReadFull(r, parity[:]); err != nil {
+			return h, unexpected(err)
+		}
+		if h.parity = int(binary.BigEndian.Uint32(parity[:])); h.parity <= 0 {
+			return h, ErrNotStream
+		}
+	}
+	if h.has(flagDeduped) {
+		var cache [4]byte
+		if _, err = io.ReadFull(r, cache[:]); err != nil {
+			return h, unexpected(err)
+		}
+		if h.cache = int(binary.BigEndian.Uint32(cache[:])); h.cache <= 0 {
+			return h, ErrNotStream
+		}
+	}
+	if h.has(flagSigned) {
+		var every [4]byte
+		if _, err = io.ReadFull(r, every[:]); err != nil {
+			return h, unexpected(err)
+		}
+		if h.signEvery = int(binary.BigEndian.Uint32(every[:])); h.signEvery <= 0 {
+			return h, ErrNotStream
+		}
+	}
+	return h, nil
+}
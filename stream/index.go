@@ -0,0 +1,284 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// footerMagic identifies the footer of an indexed stream
+const footerMagic = "\x89MIX"
+
+// footerSize is the encoded length of a footer: the offset and frame index
+// of the first index frame, followed by the magic
+const footerSize = 8 + 8 + len(footerMagic)
+
+var (
+	ErrNoIndex = errors.New("stream has no index")
+	ErrWhence  = errors.New("invalid whence")
+	ErrOffset  = errors.New("negative offset")
+)
+
+// indexEntry locates a single chunk within the encoded and decoded stream
+type indexEntry struct {
+	offset int64 // stream offset of the chunk's frame
+	frame  int64 // index of the chunk's frame
+	start  int64 // decoded offset of the chunk
+	length int   // decoded length of the chunk
+}
+
+// chunkIndex collects the entries of all chunks of a stream
+type chunkIndex []indexEntry
+
+// add the entry of a chunk, which follows all chunks added before
+func (ci *chunkIndex) add(offset, frame int64, length int) {
+	var start int64
+	if n := len(*ci); n > 0 {
+		last := (*ci)[n-1]
+		start = last.start + int64(last.length)
+	}
+	*ci = append(*ci, indexEntry{offset, frame, start, length})
+}
+
+// writeTo the stream as index frames, each up to the stream's payload
+// limit, followed by the end of the stream and the footer. Entries are
+// encoded as varints relative to the previous one.
+func (ci chunkIndex) writeTo(fw *FrameWriter) error {
+	if err := fw.writeHeader(); err != nil {
+		return err
+	}
+	offset, first := fw.offset, fw.index
+
+	var prev indexEntry
+	var b [3 * binary.MaxVarintLen64]byte
+	payload := make([]byte, 0, fw.header.maxPayload())
+	for _, e := range ci {
+		n := binary.PutUvarint(b[:], uint64(e.offset-prev.offset))
+		n += binary.PutUvarint(b[n:], uint64(e.frame-prev.frame))
+		n += binary.PutUvarint(b[n:], uint64(e.length))
+		prev = e
+
+		if len(payload)+n > cap(payload) {
+			if err := fw.WriteFrame(Frame{Type: FrameIndex, Payload: payload}); err != nil {
+				return err
+			}
+			payload = payload[:0]
+		}
+		payload = append(payload, b[:n]...)
+	}
+	if len(payload) > 0 {
+		if err := fw.WriteFrame(Frame{Type: FrameIndex, Payload: payload}); err != nil {
+			return err
+		}
+	}
+
+	if err := fw.WriteFrame(Frame{Type: FrameEnd}); err != nil {
+		return err
+	}
+
+	var footer [footerSize]byte
+	binary.BigEndian.PutUint64(footer[:], uint64(offset))
+	binary.BigEndian.PutUint64(footer[8:], uint64(first))
+	copy(footer[16:], footerMagic)
+	_, err := fw.w.Write(footer[:])
+	return err
+}
+
+// readIndex of a stream, given the reader positioned at its first index
+// frame
+func readIndex(fr *FrameReader) (ci chunkIndex, err error) {
+	var prev indexEntry
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if f.Type == FrameEnd {
+			return ci, nil
+		}
+		if f.Type != FrameIndex {
+			return nil, fr.corrupt()
+		}
+
+		for p := f.Payload; len(p) > 0; {
+			var fields [3]uint64
+			for i := range fields {
+				v, n := binary.Uvarint(p)
+				if n <= 0 {
+					return nil, fr.corrupt()
+				}
+				fields[i], p = v, p[n:]
+			}
+
+			e := indexEntry{
+				offset: prev.offset + int64(fields[0]),
+				frame:  prev.frame + int64(fields[1]),
+				start:  prev.start + int64(prev.length),
+				length: int(fields[2]),
+			}
+			ci, prev = append(ci, e), e
+		}
+	}
+}
+
+// SeekableDecoder decodes an indexed stream with random access. Only the
+// chunks covering the data read are decoded.
+type SeekableDecoder struct {
+	src   io.ReaderAt
+	size  int64 // decoded size of the stream
+	index chunkIndex
+	pos   int64
+
+	lock  sync.Mutex // guards everything below
+	fr    FrameReader
+	chunk []byte // last decoded chunk
+	at    int    // index entry of the last decoded chunk
+}
+
+// NewSeekableDecoder given an indexed stream of the given encoded size.
+// Options are requirements, just as with a Decoder.
+func NewSeekableDecoder(src io.ReaderAt, size int64, opts ...Option) (*SeekableDecoder, error) {
+	sd := &SeekableDecoder{src: src, at: -1}
+	sd.fr.r = io.NewSectionReader(src, 0, size)
+	c := newConfig(opts)
+	if err := sd.fr.readHeader(c); err != nil {
+		return nil, err
+	}
+	if !sd.fr.header.has(flagIndexed) {
+		return nil, ErrNoIndex
+	}
+	if sd.fr.header.has(flagChannels) || sd.fr.header.has(flagWindowed) {
+		return nil, ErrIncompatible
+	}
+
+	// Resolving references and verifying signatures need every chunk
+	// before them
+	if sd.fr.header.has(flagDeduped) || c.publicKey != nil {
+		return nil, ErrIncompatible
+	}
+
+	// The footer locates the index
+	var footer [footerSize]byte
+	if size < int64(footerSize) {
+		return nil, ErrNoIndex
+	}
+	if _, err := src.ReadAt(footer[:], size-int64(footerSize)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[16:], []byte(footerMagic)) {
+		return nil, ErrNoIndex
+	}
+	offset := int64(binary.BigEndian.Uint64(footer[:]))
+	first := int64(binary.BigEndian.Uint64(footer[8:]))
+	if offset < 0 || offset > size {
+		return nil, ErrNoIndex
+	}
+
+	var err error
+	sd.fr.seek(io.NewSectionReader(src, offset, size-offset), offset, first, 0)
+	if sd.index, err = readIndex(&sd.fr); err != nil {
+		return nil, err
+	}
+	if n := len(sd.index); n > 0 {
+		sd.size = sd.index[n-1].start + int64(sd.index[n-1].length)
+	}
+	return sd, nil
+}
+
+// Size of the decoded stream
+func (sd *SeekableDecoder) Size() int64 {
+	return sd.size
+}
+
+// Read decoded data from the current position
+func (sd *SeekableDecoder) Read(p []byte) (n int, err error) {
+	n, err = sd.ReadAt(p, sd.pos)
+	sd.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+// Seek to a position within the decoded stream
+func (sd *SeekableDecoder) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sd.pos
+	case io.SeekEnd:
+		offset += sd.size
+	default:
+		return 0, ErrWhence
+	}
+	if offset < 0 {
+		return 0, ErrOffset
+	}
+
+	sd.pos = offset
+	return offset, nil
+}
+
+// ReadAt reads decoded data from the given offset, decoding only the
+// chunks which hold it
+func (sd *SeekableDecoder) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrOffset
+	}
+
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	for n < len(p) {
+		if off >= sd.size {
+			return n, io.EOF
+		}
+
+		// Find the last chunk starting at or before the offset
+		i := sort.Search(len(sd.index), func(i int) bool {
+			return sd.index[i].start > off
+		}) - 1
+		if err = sd.decode(i); err != nil {
+			return
+		}
+
+		m := copy(p[n:], sd.chunk[off-sd.index[i].start:])
+		n += m
+		off += int64(m)
+	}
+	return
+}
+
+// decode the chunk of the given index entry, unless it's already decoded.
+// Must be called with the lock held.
+func (sd *SeekableDecoder) decode(i int) error {
+	if sd.at == i {
+		return nil
+	}
+
+	e := sd.index[i]
+	sd.fr.seek(io.NewSectionReader(sd.src, e.offset, 1<<62), e.offset, e.frame, int64(i))
+	sd.fr.sequence = sd.fr.header.start.Sequence + uint64(i)
+	f, err := sd.fr.ReadFrame()
+	if err != nil {
+		return unexpected(err)
+	}
+	if f.Type != FrameData {
+		return sd.fr.corrupt()
+	}
+
+	chunk, err := sd.fr.Data(f)
+	if err != nil {
+		return err
+	}
+	if len(chunk) != e.length {
+		return sd.fr.corrupt()
+	}
+
+	sd.chunk = append(sd.chunk[:0], chunk...)
+	sd.at = i
+	return nil
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestSeekable(t *testing.T) {
+	Convey("Given an indexed stream of many chunks, flushed at odd places", t, func() {
+		in := randomBytes(CHUNK_SIZE*40 + CHUNK_SIZE/3)
+		opts := []Option{WithIndex(), WithChecksum(), WithCompression(Flate), WithAEAD(newAEAD(testKey))}
+
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, opts...)
+		for p := in; len(p) > 0; {
+			n := rand.Intn(CHUNK_SIZE * 3)
+			if n > len(p) {
+				n = len(p)
+			}
+			e.Write(p[:n])
+			So(e.Flush(), ShouldBeNil)
+			p = p[n:]
+		}
+		So(e.Close(), ShouldBeNil)
+
+		src := bytes.NewReader(s.Bytes())
+		sd, err := NewSeekableDecoder(src, src.Size(), opts...)
+		So(err, ShouldBeNil)
+		So(sd.Size(), ShouldEqual, len(in))
+
+		Convey("Then it should read out intact from the start", func() {
+			out, err := ioutil.ReadAll(sd)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then reads at random offsets should match the input", func() {
+			for i := 0; i < 100; i++ {
+				off := rand.Intn(len(in))
+				p := make([]byte, rand.Intn(CHUNK_SIZE*3))
+				n, err := sd.ReadAt(p, int64(off))
+
+				want := in[off:]
+				if len(want) > len(p) {
+					want = want[:len(p)]
+				} else {
+					So(err, ShouldEqual, io.EOF)
+				}
+				So(p[:n], ShouldResemble, want)
+			}
+		})
+
+		Convey("Then seeking should move where reads start", func() {
+			pos, err := sd.Seek(-CHUNK_SIZE/2, io.SeekEnd)
+			So(err, ShouldBeNil)
+			So(pos, ShouldEqual, len(in)-CHUNK_SIZE/2)
+
+			out, err := ioutil.ReadAll(sd)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in[pos:])
+
+			_, err = sd.Seek(-1, io.SeekStart)
+			So(err, ShouldEqual, ErrOffset)
+		})
+
+		Convey("Then a streaming Decoder should still decode it", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, opts...))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then corrupting a chunk should only fail reads covering it", func() {
+			b := append([]byte(nil), s.Bytes()...)
+			b[len(b)/3] ^= 0xff
+			sd, err := NewSeekableDecoder(bytes.NewReader(b), int64(len(b)), opts...)
+			So(err, ShouldBeNil)
+
+			p := make([]byte, CHUNK_SIZE)
+			_, err = sd.ReadAt(p, 0)
+			So(err, ShouldBeNil)
+
+			_, err = ioutil.ReadAll(sd)
+			So(err, ShouldHaveSameTypeAs, &CorruptionError{})
+		})
+	})
+
+	Convey("Given a stream without an index", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE * 2))
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a SeekableDecoder should refuse it", func() {
+			_, err := NewSeekableDecoder(bytes.NewReader(s.Bytes()), int64(s.Len()))
+			So(err, ShouldEqual, ErrNoIndex)
+		})
+	})
+
+	Convey("Given an empty indexed stream", t, func() {
+		var s bytes.Buffer
+		So(NewEncoder(&s, CHUNK_SIZE, WithIndex()).Close(), ShouldBeNil)
+
+		Convey("Then it should read as empty", func() {
+			sd, err := NewSeekableDecoder(bytes.NewReader(s.Bytes()), int64(s.Len()))
+			So(err, ShouldBeNil)
+			out, err := ioutil.ReadAll(sd)
+			So(err, ShouldBeNil)
+			So(out, ShouldBeEmpty)
+		})
+	})
+}
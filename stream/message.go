@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MessageTooLargeError reports a message exceeding the maximum size
+type MessageTooLargeError struct {
+	Size uint64 // size of the message
+	Max  int    // maximum message size
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds maximum of %d", e.Size, e.Max)
+}
+
+// MessageEncoder encodes a stream of discrete messages. Each message is
+// prefixed by its length, and may span as many chunks as necessary.
+type MessageEncoder struct {
+	e   *Encoder
+	max int
+	buf [binary.MaxVarintLen64]byte
+}
+
+// NewMessageEncoder given a stream to write encoded chunks to, the chunk
+// size and the maximum size of a message
+func NewMessageEncoder(s io.Writer, size, max int, opts ...Option) *MessageEncoder {
+	opts = append(opts[:len(opts):len(opts)], withMessages())
+	return &MessageEncoder{e: NewEncoder(s, size, opts...), max: max}
+}
+
+// WriteMessage encodes p as a single message
+func (me *MessageEncoder) WriteMessage(p []byte) error {
+	if len(p) > me.max {
+		return &MessageTooLargeError{Size: uint64(len(p)), Max: me.max}
+	}
+
+	n := binary.PutUvarint(me.buf[:], uint64(len(p)))
+	if _, err := me.e.Write(me.buf[:n]); err != nil {
+		return err
+	}
+	_, err := me.e.Write(p)
+	return err
+}
+
+// Flush all written messages to the stream, without ending it
+func (me *MessageEncoder) Flush() error {
+	return me.e.Flush()
+}
+
+// Close the MessageEncoder, ending the stream after the last message
+func (me *MessageEncoder) Close() error {
+	return me.e.Close()
+}
+
+// CloseWithError ends the stream after the last message with the given
+// error, which the MessageDecoder returns as a *RemoteError
+func (me *MessageEncoder) CloseWithError(err error) error {
+	return me.e.CloseWithError(err)
+}
+
+// MessageDecoder decodes a stream of messages written by a MessageEncoder
+type MessageDecoder struct {
+	d   *Decoder
+	max int
+}
+
+// NewMessageDecoder given an encoded stream of messages, and the maximum
+// size of a message to accept
+func NewMessageDecoder(s io.Reader, max int, opts ...Option) *MessageDecoder {
+	return &MessageDecoder{d: NewDecoder(s, opts...), max: max}
+}
+
+// ReadMessage decodes the next message, exactly as it was written. Returns
+// io.EOF once the stream ends after the last message, or a
+// *MessageTooLargeError without reading any further if a message exceeds
+// the maximum size.
+func (md *MessageDecoder) ReadMessage() ([]byte, error) {
+	if err := md.d.start(); err != nil {
+		return nil, err
+	}
+	if !md.d.fr.header.has(flagMessages) {
+		return nil, ErrIncompatible
+	}
+
+	sz, err := binary.ReadUvarint(md.d)
+	if err != nil {
+		return nil, err
+	}
+	if sz > uint64(md.max) {
+		return nil, &MessageTooLargeError{Size: sz, Max: md.max}
+	}
+
+	msg := make([]byte, sz)
+	if _, err = io.ReadFull(md.d, msg); err != nil {
+		return nil, unexpected(err)
+	}
+	return msg, nil
+}
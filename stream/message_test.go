@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	const MAX_MESSAGE = CHUNK_SIZE * 4
+
+	Convey("Given messages of all sizes written to a MessageEncoder", t, func() {
+		msgs := [][]byte{
+			randomBytes(CHUNK_SIZE / 10),
+			{},
+			randomBytes(CHUNK_SIZE * 3),
+			randomBytes(1),
+			randomBytes(MAX_MESSAGE),
+		}
+
+		var s bytes.Buffer
+		me := NewMessageEncoder(&s, CHUNK_SIZE, MAX_MESSAGE, WithChecksum())
+		for _, msg := range msgs {
+			So(me.WriteMessage(msg), ShouldBeNil)
+		}
+		So(me.Close(), ShouldBeNil)
+
+		Convey("Then each message should be read back exactly as written", func() {
+			md := NewMessageDecoder(&s, MAX_MESSAGE)
+			for _, msg := range msgs {
+				out, err := md.ReadMessage()
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, msg)
+			}
+
+			_, err := md.ReadMessage()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Then a decoder with a smaller maximum should refuse the large ones", func() {
+			md := NewMessageDecoder(&s, CHUNK_SIZE)
+			_, err := md.ReadMessage()
+			So(err, ShouldBeNil)
+			_, err = md.ReadMessage()
+			So(err, ShouldBeNil)
+
+			_, err = md.ReadMessage()
+			So(err, ShouldResemble, &MessageTooLargeError{Size: CHUNK_SIZE * 3, Max: CHUNK_SIZE})
+		})
+
+		Convey("Then writing a message beyond the maximum should fail", func() {
+			err := me.WriteMessage(randomBytes(MAX_MESSAGE + 1))
+			So(err, ShouldHaveSameTypeAs, &MessageTooLargeError{})
+		})
+	})
+
+	Convey("Given a stream which isn't made of messages", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE))
+		e.Close()
+
+		Convey("A MessageDecoder should refuse it", func() {
+			_, err := NewMessageDecoder(&s, CHUNK_SIZE).ReadMessage()
+			So(err, ShouldEqual, ErrIncompatible)
+		})
+	})
+}
@@ -0,0 +1,311 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrClosedChannel   = errors.New("closed channel")
+	ErrChannelOverflow = errors.New("channel buffer overflow")
+)
+
+// DefaultChannelBuffer is how much incoming data a Mux buffers for each
+// channel, unless given WithChannelBuffer
+const DefaultChannelBuffer = 4 << 20
+
+// Mux carries many logical channels over a single io.ReadWriter. Each side
+// of the Mux encodes its outgoing frames as one stream, tagging every frame
+// with the ID of its channel, and decodes the stream of the other side.
+//
+// Incoming data is buffered per channel until it is read, so a slow
+// channel doesn't hold up any other. There is no flow control, so a channel
+// whose buffer overflows fails the whole Mux.
+type Mux struct {
+	rw     io.ReadWriter
+	size   int
+	buffer int // incoming data buffered per channel
+
+	wlock sync.Mutex // serializes frames written to the stream
+	fw    FrameWriter
+	fwErr error // error creating fw, which fails every write
+
+	lock     sync.Mutex // guards everything below
+	channels map[uint64]*Channel
+	forgot   map[uint64]bool // IDs of channels closed by both sides
+	accepted []*Channel
+	accept   *sync.Cond
+	err      error // error ending the incoming stream
+	closed   bool
+}
+
+// Channel is one logical stream of a Mux. It is closed once both sides of
+// the Mux have closed it.
+type Channel struct {
+	id  uint64
+	mux *Mux
+
+	buf    []byte     // incoming data not yet read
+	read   *sync.Cond // signals incoming data, on the Mux lock
+	closed bool       // closed by this side
+	ended  bool       // closed by the other side
+}
+
+// NewMux starts multiplexing over the given stream, writing frames with
+// the given chunk size and options. Options are also requirements for the
+// incoming stream, just as with a Decoder. An invalid chunk size fails every
+// write and Accept.
+func NewMux(rw io.ReadWriter, size int, opts ...Option) *Mux {
+	c := newConfig(opts)
+	c.channels = true
+	m := &Mux{
+		rw:       rw,
+		size:     size,
+		buffer:   c.channelBuffer,
+		channels: make(map[uint64]*Channel),
+		forgot:   make(map[uint64]bool),
+	}
+	if m.buffer <= 0 {
+		m.buffer = DefaultChannelBuffer
+	}
+	m.accept = sync.NewCond(&m.lock)
+
+	if m.fw, m.fwErr = newFrameWriter(rw, size, c); m.fwErr != nil {
+		m.err = m.fwErr
+		return m
+	}
+
+	go m.readLoop(c)
+	return m
+}
+
+// Open the channel with the given ID. Opening a channel the other side
+// already uses returns that same channel. Once both sides have closed a
+// channel, data for its ID is ignored until this side opens it again.
+func (m *Mux) Open(id uint64) *Channel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.forgot, id)
+	return m.channel(id)
+}
+
+// Accept waits for the other side to open a channel, by sending its first
+// data. Returns the error ending the incoming stream once no more channels
+// can be accepted, which is io.EOF if the other side closed the Mux.
+func (m *Mux) Accept() (*Channel, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for len(m.accepted) == 0 && m.err == nil {
+		m.accept.Wait()
+	}
+	if len(m.accepted) == 0 {
+		return nil, m.err
+	}
+
+	ch := m.accepted[0]
+	m.accepted = m.accepted[1:]
+	return ch, nil
+}
+
+// Close the Mux, ending the outgoing stream. This also closes the
+// underlying stream if possible.
+func (m *Mux) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.lock.Unlock()
+
+	err := m.fwErr
+	if err == nil {
+		m.wlock.Lock()
+		err = m.fw.WriteFrame(Frame{Type: FrameEnd})
+		m.wlock.Unlock()
+	}
+
+	if closer, ok := m.rw.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// channel with the given ID, which is created if necessary. Must be called
+// with the lock held.
+func (m *Mux) channel(id uint64) *Channel {
+	ch, ok := m.channels[id]
+	if !ok {
+		ch = &Channel{id: id, mux: m, read: sync.NewCond(&m.lock)}
+		m.channels[id] = ch
+	}
+	return ch
+}
+
+// forget a channel once both sides have closed it. Must be called with the
+// lock held.
+func (m *Mux) forget(ch *Channel) {
+	if ch.closed && ch.ended {
+		delete(m.channels, ch.id)
+		m.forgot[ch.id] = true
+	}
+}
+
+// readLoop decodes the incoming stream, handing out data to channels
+func (m *Mux) readLoop(c config) {
+	err := readPeer(m.rw, c, flagChannels, nil, m.handle)
+
+	// Wake up everyone waiting on the incoming stream
+	m.lock.Lock()
+	m.err = err
+	for _, ch := range m.channels {
+		ch.read.Broadcast()
+	}
+	m.accept.Broadcast()
+	m.lock.Unlock()
+}
+
+// handle an incoming frame
+func (m *Mux) handle(fr *FrameReader, f Frame) error {
+	switch f.Type {
+	case FrameData:
+		chunk, err := fr.Data(f)
+		if err != nil {
+			return err
+		}
+		return m.deliver(f.Channel, chunk)
+	case FrameClose:
+		m.end(f.Channel)
+		return nil
+	}
+	return ErrIncompatible
+}
+
+// deliver incoming data to a channel, which is accepted if it's new.
+// Returns ErrChannelOverflow if the channel can't buffer it.
+func (m *Mux) deliver(id uint64, chunk []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Data for channels closed by this side is of no use to anyone, even
+	// if it arrives late
+	if m.forgot[id] {
+		return nil
+	}
+	ch, ok := m.channels[id]
+	if !ok {
+		ch = m.channel(id)
+		m.accepted = append(m.accepted, ch)
+		m.accept.Signal()
+	}
+	if ch.closed {
+		return nil
+	}
+
+	if len(ch.buf)+len(chunk) > m.buffer {
+		return ErrChannelOverflow
+	}
+	ch.buf = append(ch.buf, chunk...)
+	ch.read.Broadcast()
+	return nil
+}
+
+// end a channel closed by the other side
+func (m *Mux) end(id uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if ch, ok := m.channels[id]; ok {
+		ch.ended = true
+		ch.read.Broadcast()
+		m.forget(ch)
+	}
+}
+
+// ID of the channel within its Mux
+func (ch *Channel) ID() uint64 {
+	return ch.id
+}
+
+// Read data sent over the channel by the other side. Blocks until data is
+// available. Returns io.EOF after the other side closed the channel.
+func (ch *Channel) Read(p []byte) (n int, err error) {
+	m := ch.mux
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for len(ch.buf) == 0 && !ch.closed && !ch.ended && m.err == nil {
+		ch.read.Wait()
+	}
+
+	switch {
+	case len(ch.buf) > 0:
+		n = copy(p, ch.buf)
+		ch.buf = ch.buf[n:]
+		return n, nil
+	case ch.closed:
+		return 0, ErrClosedChannel
+	case ch.ended:
+		return 0, io.EOF
+	default:
+		return 0, m.err
+	}
+}
+
+// Write data to the channel, sending it right away in as many chunks as
+// necessary
+func (ch *Channel) Write(p []byte) (n int, err error) {
+	m := ch.mux
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+
+	// Closing takes the write lock after marking the channel closed, so no
+	// data follows its close frame
+	m.lock.Lock()
+	closed := ch.closed || m.closed
+	m.lock.Unlock()
+	if closed {
+		return 0, ErrClosedChannel
+	}
+	if m.fwErr != nil {
+		return 0, m.fwErr
+	}
+
+	for n < len(p) {
+		sz := len(p) - n
+		if sz > m.size {
+			sz = m.size
+		}
+		if err = m.fw.writeData(ch.id, p[n:n+sz]); err != nil {
+			return
+		}
+		n += sz
+	}
+	return
+}
+
+// Close the channel, telling the other side that no more data follows.
+// Any data still arriving for the channel is discarded.
+func (ch *Channel) Close() error {
+	m := ch.mux
+	m.lock.Lock()
+	if ch.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	ch.closed, ch.buf = true, nil
+	ch.read.Broadcast()
+	m.forget(ch)
+	m.lock.Unlock()
+
+	if m.fwErr != nil {
+		return m.fwErr
+	}
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+	return m.fw.WriteFrame(Frame{Type: FrameClose, Channel: ch.id})
+}
@@ -0,0 +1,150 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	Convey("Given two Muxes connected to each other", t, func() {
+		a, b := net.Pipe()
+		ma, mb := NewMux(a, CHUNK_SIZE, WithChecksum()), NewMux(b, CHUNK_SIZE, WithChecksum())
+
+		Convey("When one side writes to a few channels at once", func() {
+			ins := make([][]byte, 3)
+			for i := range ins {
+				ins[i] = randomBytes(CHUNK_SIZE*(i+1) + CHUNK_SIZE/3)
+			}
+
+			for i, in := range ins {
+				go func(ch *Channel, in []byte) {
+					ch.Write(in)
+					ch.Close()
+				}(ma.Open(uint64(i)), in)
+			}
+
+			Convey("Then the other side should accept them and read them out intact", func() {
+				for range ins {
+					ch, err := mb.Accept()
+					So(err, ShouldBeNil)
+
+					out, err := ioutil.ReadAll(ch)
+					So(err, ShouldBeNil)
+					So(out, ShouldResemble, ins[ch.ID()])
+					So(ch.Close(), ShouldBeNil)
+				}
+			})
+		})
+
+		Convey("When both sides talk over the same channel", func() {
+			in := randomBytes(CHUNK_SIZE / 2)
+			cha, chb := ma.Open(7), mb.Open(7)
+			go cha.Write(in)
+
+			Convey("Then replies should arrive on the same channel", func() {
+				buf := make([]byte, len(in))
+				_, err := io.ReadFull(chb, buf)
+				So(err, ShouldBeNil)
+				go chb.Write(bytes.Repeat(buf, 2))
+
+				out := make([]byte, 2*len(in))
+				_, err = io.ReadFull(cha, out)
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, bytes.Repeat(in, 2))
+			})
+		})
+
+		Convey("When the other side doesn't meet this side's requirements", func() {
+			mc := NewMux(b, CHUNK_SIZE)
+			go mc.Open(1).Write([]byte("unchecked"))
+
+			Convey("Then no channels should be accepted from it", func() {
+				_, err := ma.Accept()
+				So(err, ShouldEqual, ErrNoChecksum)
+			})
+		})
+
+		Convey("When one side closes the Mux", func() {
+			So(ma.Close(), ShouldBeNil)
+
+			Convey("Then the other side should accept no more channels", func() {
+				_, err := mb.Accept()
+				So(err, ShouldEqual, io.EOF)
+			})
+		})
+
+		Convey("When data arrives late for a channel both sides closed", func() {
+			mb.lock.Lock()
+			ch := mb.channel(5)
+			ch.closed, ch.ended = true, true
+			mb.forget(ch)
+			mb.lock.Unlock()
+			So(mb.deliver(5, []byte("late")), ShouldBeNil)
+
+			Convey("Then it should be ignored, rather than open the channel again", func() {
+				mb.lock.Lock()
+				defer mb.lock.Unlock()
+				So(mb.accepted, ShouldBeEmpty)
+				So(mb.channels, ShouldNotContainKey, uint64(5))
+			})
+
+			Convey("Then this side should still be able to open it again", func() {
+				ch := mb.Open(5)
+				So(mb.deliver(5, []byte("again")), ShouldBeNil)
+				buf := make([]byte, 5)
+				_, err := io.ReadFull(ch, buf)
+				So(err, ShouldBeNil)
+				So(string(buf), ShouldEqual, "again")
+			})
+		})
+
+		Reset(func() {
+			ma.Close()
+			mb.Close()
+		})
+	})
+
+	Convey("Given a Mux buffering little for each channel", t, func() {
+		a, b := net.Pipe()
+		ma, mb := NewMux(a, CHUNK_SIZE), NewMux(b, CHUNK_SIZE, WithChannelBuffer(CHUNK_SIZE*2))
+
+		Convey("When more than that arrives for a channel nobody reads", func() {
+			go ma.Open(1).Write(randomBytes(CHUNK_SIZE * 3))
+
+			Convey("Then the Mux should fail", func() {
+				_, err := mb.Accept()
+				So(err, ShouldBeNil)
+				_, err = mb.Accept()
+				So(err, ShouldEqual, ErrChannelOverflow)
+			})
+		})
+
+		Reset(func() {
+			ma.Close()
+			mb.Close()
+		})
+	})
+
+	Convey("Given Muxes with invalid chunk sizes", t, func() {
+		sizes := map[int]error{
+			0:                       ErrInvalidSize,
+			DefaultMaxChunkSize + 1: &ChunkSizeError{Size: DefaultMaxChunkSize + 1, Max: DefaultMaxChunkSize},
+		}
+
+		Convey("Then writing and closing should fail", func() {
+			for size, want := range sizes {
+				a, _ := net.Pipe()
+				m := NewMux(a, size)
+				ch := m.Open(1)
+				_, err := ch.Write([]byte("data"))
+				So(err, ShouldResemble, want)
+				So(ch.Close(), ShouldResemble, want)
+				So(m.Close(), ShouldResemble, want)
+			}
+		})
+	})
+}
@@ -0,0 +1,285 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// castagnoli is the CRC-32C table used for chunk checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the length of the CRC-32C trailer following each chunk
+const checksumSize = crc32.Size
+
+// Option configures an Encoder or Decoder. An Encoder records its options in
+// the stream header, while a Decoder treats them as requirements.
+type Option func(*config)
+
+// config holds the optional features of an Encoder or Decoder
+type config struct {
+	checksum      bool
+	codec         Codec
+	aead          cipher.AEAD
+	channels      bool // tag frames with channels, for a Mux
+	channelBuffer int  // incoming data buffered per channel, by a Mux
+	window        int  // unacknowledged bytes allowed, for a Session
+	messages      bool // data is a sequence of messages
+	index         bool
+	trailer       bool
+	sequenced     bool
+	resume        *Checkpoint // where a sequenced stream starts
+	parity        int         // data frames per parity frame
+	minChunk      int         // with content-defined chunking
+	avgChunk      int         // with content-defined chunking
+	dedup         int         // bytes of chunks cached for deduplication
+	maxChunk      int         // largest chunk size accepted, if not the default
+
+	privateKey ed25519.PrivateKey // signs the stream
+	signEvery  int                // chunks per signature
+	publicKey  ed25519.PublicKey  // verifies the stream's signatures
+
+	handlers map[FrameType]func(Frame) error // of custom frames
+
+	concurrency       int
+	flushInterval     time.Duration
+	heartbeatInterval time.Duration
+}
+
+// WithChecksum appends a CRC-32C trailer to every chunk. Decoders verify each
+// chunk before handing out any of its data.
+func WithChecksum() Option {
+	return func(c *config) {
+		c.checksum = true
+	}
+}
+
+// WithCompression compresses every chunk on its own with the given codec.
+// Chunks which don't shrink are stored as they are. Decoders look the codec
+// up among those registered with RegisterCodec.
+func WithCompression(c Codec) Option {
+	return func(cfg *config) {
+		cfg.codec = c
+	}
+}
+
+// WithAEAD seals every frame with the given authenticated cipher, such as
+// AES-GCM from crypto/cipher or ChaCha20-Poly1305 from x/crypto. Decoders
+// must be given the same cipher and key, and detect any tampering with,
+// reordering, replay or truncation of frames, and any tampering with the
+// stream header.
+func WithAEAD(aead cipher.AEAD) Option {
+	return func(c *config) {
+		c.aead = aead
+	}
+}
+
+// WithConcurrency compresses up to n chunks at once. An Encoder still
+// writes chunks in order, but keeps up to n of them until they are
+// compressed. A Decoder reads and decompresses up to n chunks ahead in the
+// background, until the end of the stream or an error. It has no effect on
+// streams without compression.
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		c.concurrency = n
+	}
+}
+
+// WithChannelBuffer makes a Mux buffer up to n bytes of incoming data for
+// each channel, in place of DefaultChannelBuffer. A channel whose buffer
+// overflows fails the Mux with ErrChannelOverflow. It has no effect on
+// Encoders and Decoders.
+func WithChannelBuffer(n int) Option {
+	return func(c *config) {
+		c.channelBuffer = n
+	}
+}
+
+// WithFlushInterval makes an Encoder flush buffered data as a partial chunk
+// once it has waited for the given duration. This bounds the latency of
+// small writes without calling Flush after each one.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.flushInterval = d
+	}
+}
+
+// WithHeartbeat makes an Encoder write an empty heartbeat frame whenever
+// it has written nothing else for the given duration, so idle connections
+// aren't cut by middleboxes. Decoders skip heartbeats, but take note of
+// when they arrive.
+func WithHeartbeat(d time.Duration) Option {
+	return func(c *config) {
+		c.heartbeatInterval = d
+	}
+}
+
+// WithIndex makes an Encoder append an index of all chunks when it's
+// closed, followed by a footer locating the index. A SeekableDecoder uses
+// it for random access to the stream. Since the footer follows the end of
+// the stream, this is meant for streams stored in files.
+func WithIndex() Option {
+	return func(c *config) {
+		c.index = true
+	}
+}
+
+// WithTrailer makes an Encoder end the stream with a Trailer, recording the
+// length and SHA-256 digest of all data along with any fields set on the
+// Encoder. Decoders verify the stream against its trailer before returning
+// io.EOF, and refuse streams without one.
+func WithTrailer() Option {
+	return func(c *config) {
+		c.trailer = true
+	}
+}
+
+// WithSequence numbers every chunk, so a receiver can tell how far it has
+// durably processed a stream with Decoder.Checkpoint. Decoders refuse
+// streams without sequence numbers.
+func WithSequence() Option {
+	return func(c *config) {
+		c.sequenced = true
+	}
+}
+
+// WithResume numbers every chunk like WithSequence, but starts the stream
+// at the given Checkpoint of an earlier one. The data written to an Encoder
+// must start at the Checkpoint's offset, as with NewResumedEncoder.
+// Decoders refuse streams starting anywhere else.
+func WithResume(cp Checkpoint) Option {
+	return func(c *config) {
+		c.sequenced = true
+		c.resume = &cp
+	}
+}
+
+// WithParity makes an Encoder follow every k data chunks with a parity
+// chunk, from which a DatagramDecoder reconstructs any single chunk of the
+// group which was lost. Chunks are numbered as with WithSequence. Decoders
+// reading the stream in full skip parity chunks, and DatagramDecoders refuse
+// groups of more than 1024 chunks.
+func WithParity(k int) Option {
+	return func(c *config) {
+		c.sequenced = true
+		c.parity = k
+	}
+}
+
+// WithContentDefinedChunking makes an Encoder cut chunks where the content
+// calls for it, rather than every size bytes, so inserting or removing data
+// only changes the chunks around it. Chunks are usually min to a few times
+// avg bytes long, but never more than the Encoder's size, which must be at
+// least avg. It has no effect on Decoders.
+func WithContentDefinedChunking(min, avg int) Option {
+	return func(c *config) {
+		c.minChunk = min
+		c.avgChunk = avg
+	}
+}
+
+// WithDeduplication makes an Encoder send a reference in place of any chunk
+// it sent before and still has cached, keeping up to cache bytes of the
+// chunks most recently sent. Decoders keep an identical cache to resolve
+// references. Pairs well with content-defined chunking, which makes
+// repeated content produce repeated chunks.
+func WithDeduplication(cache int) Option {
+	return func(c *config) {
+		c.dedup = cache
+	}
+}
+
+// WithSigning makes an Encoder chain the digests of all chunks, and sign
+// the head of the chain with the given key after every n chunks, whenever
+// the Encoder is flushed, and once more when it's closed. Decoders which
+// aren't given the public key skip the signatures.
+func WithSigning(key ed25519.PrivateKey, n int) Option {
+	return func(c *config) {
+		c.privateKey = key
+		if c.signEvery = n; n < 1 {
+			c.signEvery = 1
+		}
+	}
+}
+
+// WithVerification makes a Decoder verify a signed stream against the given
+// public key. It holds back each chunk until a signature covering it is
+// verified, and refuses unsigned streams.
+func WithVerification(key ed25519.PublicKey) Option {
+	return func(c *config) {
+		c.publicKey = key
+	}
+}
+
+// WithMaxChunkSize makes a Decoder refuse streams whose chunk size exceeds
+// n bytes with a *ChunkSizeError, in place of DefaultMaxChunkSize. Streams
+// whose deduplication cache, or chunks between signatures, would take more
+// than 64 times n bytes are refused with ErrMemoryLimit. Together, these
+// bound what a hostile stream can make a Decoder allocate. Encoders refuse
+// to write streams their own Decoders would refuse.
+func WithMaxChunkSize(n int) Option {
+	return func(c *config) {
+		c.maxChunk = n
+	}
+}
+
+// WithFrameHandler makes a Decoder call h with every custom frame of type
+// t, in order with the data around it. The frame's Payload is only valid
+// until h returns, and an error from h ends decoding. Types below
+// FrameCustom are reserved, so handlers for them are ignored. It has no
+// effect on Encoders.
+func WithFrameHandler(t FrameType, h func(Frame) error) Option {
+	return func(c *config) {
+		if !t.custom() {
+			return
+		}
+		if c.handlers == nil {
+			c.handlers = make(map[FrameType]func(Frame) error)
+		}
+		c.handlers[t] = h
+	}
+}
+
+// withMessages marks the stream as a sequence of messages
+func withMessages() Option {
+	return func(c *config) {
+		c.messages = true
+	}
+}
+
+// maxChunkSize is the largest chunk size accepted
+func (c config) maxChunkSize() int {
+	if c.maxChunk > 0 {
+		return c.maxChunk
+	}
+	return DefaultMaxChunkSize
+}
+
+// checkLimits of a stream's header: its chunk size, and how much of it a
+// Decoder may have to hold at once
+func (c config) checkLimits(h header) error {
+	max := c.maxChunkSize()
+	if h.size > max {
+		return &ChunkSizeError{Size: h.size, Max: max}
+	}
+
+	held := min(int64(max)*maxHeldChunks, math.MaxUint32)
+	if h.has(flagDeduped) && int64(h.cache) > held {
+		return ErrMemoryLimit
+	}
+	if h.has(flagSigned) && int64(h.signEvery)*int64(h.maxPayload()) > held {
+		return ErrMemoryLimit
+	}
+	return nil
+}
+
+// newConfig applies the given options to a default config
+func newConfig(opts []Option) config {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
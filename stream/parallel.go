@@ -0,0 +1,169 @@
+package stream
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// compressJob compresses a chunk of an Encoder in the background
+type compressJob struct {
+	chunk      []byte
+	compressed []byte
+	err        error
+	done       chan struct{} // closed once compressed
+}
+
+// compress the job's chunk with the given codec
+func (job *compressJob) compress(codec Codec) {
+	job.compressed, job.err = codec.Compress(job.compressed[:0], job.chunk)
+	close(job.done)
+}
+
+// submit a chunk for compression in the background. Chunks are written in
+// order once compressed, with at most the Encoder's concurrency in flight.
+// Must be called with the lock held.
+func (e *Encoder) submit(chunk []byte) error {
+	var job *compressJob
+	if n := len(e.free); n > 0 {
+		job, e.free = e.free[n-1], e.free[:n-1]
+	} else {
+		job = new(compressJob)
+	}
+	job.chunk = append(job.chunk[:0], chunk...)
+	job.done = make(chan struct{})
+	go job.compress(e.fw.codec)
+
+	e.pending = append(e.pending, job)
+	if len(e.pending) < e.concurrency {
+		return nil
+	}
+	return e.drain(1)
+}
+
+// drain up to n of the oldest pending chunks, waiting for each to be
+// compressed before writing it. Must be called with the lock held.
+func (e *Encoder) drain(n int) error {
+	for ; n > 0 && len(e.pending) > 0; n-- {
+		job := e.pending[0]
+		<-job.done
+		e.pending = append(e.pending[:0], e.pending[1:]...)
+
+		err := job.err
+		if err == nil {
+			err = e.writeChunk(job.chunk, job.compressed)
+		}
+		e.free = append(e.free, job)
+		if err != nil {
+			e.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// readAhead reads the frames of a stream in the background for a Decoder,
+// decompressing data frames in parallel. It stops after the end of the
+// stream, an error, or once the Decoder has ended.
+type readAhead struct {
+	frames chan *aheadFrame
+	done   chan struct{} // closed once the Decoder has ended
+	cur    *aheadFrame   // frame last handed out
+}
+
+// aheadFrame is a frame read ahead, along with its chunk once decompressed
+type aheadFrame struct {
+	f      Frame
+	err    error // error reading the frame
+	index  int64 // index of the frame
+	nth    int64 // index of the frame among chunks
+	offset int64 // stream offset of the frame
+
+	chunk   []byte
+	dataErr error         // error decompressing the chunk
+	done    chan struct{} // closed once decompressed
+}
+
+// startReadAhead of the Decoder using the given FrameReader, which it
+// mustn't touch anymore, by up to n frames
+func startReadAhead(fr *FrameReader, n int, lastFrame *atomic.Int64) *readAhead {
+	ra := &readAhead{frames: make(chan *aheadFrame, n), done: make(chan struct{})}
+	go ra.run(fr, lastFrame)
+	return ra
+}
+
+// run reads frames until the end of the stream, or an error
+func (ra *readAhead) run(fr *FrameReader, lastFrame *atomic.Int64) {
+	defer close(ra.frames)
+
+	for {
+		f, err := fr.ReadFrame()
+		af := &aheadFrame{f: f, err: err, index: fr.index, nth: fr.chunk, offset: fr.offset, done: make(chan struct{})}
+		if err != nil {
+			close(af.done)
+			ra.send(af)
+			return
+		}
+		lastFrame.Store(time.Now().UnixNano())
+
+		// The FrameReader reuses its buffer for the next frame
+		af.f.Payload = append([]byte(nil), f.Payload...)
+		if f.Type == FrameData {
+			go af.decompress(fr.codec, fr.header.size)
+		} else {
+			close(af.done)
+		}
+		if !ra.send(af) || f.Type == FrameEnd || f.Type == FrameError {
+			return
+		}
+	}
+}
+
+// send a frame to the Decoder, returning false if it has ended instead
+func (ra *readAhead) send(af *aheadFrame) bool {
+	select {
+	case ra.frames <- af:
+		return true
+	case <-ra.done:
+		return false
+	}
+}
+
+// stop reading ahead, as the Decoder has ended
+func (ra *readAhead) stop() {
+	select {
+	case <-ra.done:
+	default:
+		close(ra.done)
+	}
+}
+
+// next frame read ahead
+func (ra *readAhead) next() (Frame, error) {
+	af, ok := <-ra.frames
+	if !ok {
+		return Frame{}, io.EOF
+	}
+	ra.cur = af
+	return af.f, af.err
+}
+
+// data of the frame last handed out, once decompressed
+func (ra *readAhead) data() ([]byte, error) {
+	<-ra.cur.done
+	return ra.cur.chunk, ra.cur.dataErr
+}
+
+// decompress the frame's chunk
+func (af *aheadFrame) decompress(codec Codec, limit int) {
+	af.chunk, af.dataErr = decodePayload(codec, nil, af.f, limit)
+	if af.dataErr == errCorruptPayload {
+		af.dataErr = af.corrupt()
+	}
+	close(af.done)
+}
+
+// corrupt builds an error describing the frame
+func (af *aheadFrame) corrupt() error {
+	return &CorruptionError{Frame: af.index, Chunk: af.nth, Offset: af.offset}
+}
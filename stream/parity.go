@@ -0,0 +1,340 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// parityOverhead is the most by which the payload of a parity frame exceeds
+// the chunk size: the sequence number of its first chunk, the number of
+// chunks, and their lengths
+const parityOverhead = 3 * binary.MaxVarintLen64
+
+// maxDatagram is the largest datagram a DatagramDecoder accepts before it
+// knows the stream's frame size
+const maxDatagram = 1 << 16
+
+// maxParity is the most chunks per group a DatagramDecoder accepts
+const maxParity = 1 << 10
+
+// maxGroupsAhead is how many groups past any chunk seen a frame may be, in a
+// stream without checksums. A frame further ahead is taken to be corrupt,
+// rather than to follow that many lost groups.
+const maxGroupsAhead = 64
+
+var ErrNoParity = errors.New("stream has no parity")
+
+// LostChunkError reports a chunk which never arrived and couldn't be
+// reconstructed. Reading may continue past it, with the next chunk.
+type LostChunkError struct {
+	Sequence uint64 // sequence number of the chunk
+}
+
+func (e *LostChunkError) Error() string {
+	return fmt.Sprintf("lost chunk %d", e.Sequence)
+}
+
+// parityGroup accumulates the parity of a group of consecutive chunks: the
+// XOR of the chunks, each zero padded to the longest, and of their lengths
+type parityGroup struct {
+	k      int    // chunks per group
+	first  uint64 // sequence number of the first chunk
+	count  int
+	length uint64
+	data   []byte
+	buf    []byte
+}
+
+// add the chunk with the given sequence number to the group. Returns true
+// once the group is full.
+func (pg *parityGroup) add(sequence uint64, chunk []byte) bool {
+	if pg.count == 0 {
+		pg.first, pg.length, pg.data = sequence, 0, pg.data[:0]
+	}
+	if n := len(chunk) - len(pg.data); n > 0 {
+		pg.data = append(pg.data, make([]byte, n)...)
+	}
+	xor(pg.data, chunk)
+	pg.length ^= uint64(len(chunk))
+	pg.count++
+	return pg.count == pg.k
+}
+
+// payload of the group's parity frame, which also starts the next group.
+// The payload is only valid until the next call.
+func (pg *parityGroup) payload() []byte {
+	b := binary.AppendUvarint(pg.buf[:0], pg.first)
+	b = binary.AppendUvarint(b, uint64(pg.count))
+	b = binary.AppendUvarint(b, pg.length)
+	pg.buf = append(b, pg.data...)
+	pg.count = 0
+	return pg.buf
+}
+
+// parseParity from the payload of a parity frame
+func parseParity(p []byte) (first, count, length uint64, data []byte, ok bool) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(p)
+		if n <= 0 {
+			return
+		}
+		fields[i], p = v, p[n:]
+	}
+	return fields[0], fields[1], fields[2], p, true
+}
+
+// writeParity of the chunks written since the last parity frame, if any.
+// Must be called with the lock held.
+func (e *Encoder) writeParity() error {
+	if e.parity == nil || e.parity.count == 0 {
+		return nil
+	}
+	return e.fw.WriteFrame(Frame{Type: FrameParity, Payload: e.parity.payload()})
+}
+
+// xor src into dst, which must be at least as long
+func xor(dst, src []byte) {
+	for i, c := range src {
+		dst[i] ^= c
+	}
+}
+
+// DatagramDecoder decodes a sequenced stream whose frames arrive as
+// datagrams, each returned by a single Read, such as from a UDP connection.
+// An Encoder writes its header and each frame with a single Write, so it
+// can write straight to one.
+//
+// The header must arrive first, but any later datagram may be lost, as long
+// as the rest arrive in order. Datagrams which aren't a valid frame are
+// dropped as if lost, and so are those too far past the chunks seen so far
+// in a stream without checksums. Streams encoded WithParity have each lost chunk
+// reconstructed if it is the only one of its group to be lost. Any chunk
+// which can't be is returned as a *LostChunkError in its place, after which
+// reading continues. Sealed and deduplicated streams aren't supported, and
+// neither are channels, windows or verifying signatures.
+type DatagramDecoder struct {
+	s          io.Reader
+	config     config
+	fr         FrameReader
+	dgram      []byte
+	readHeader bool
+	start      uint64 // sequence number of the first chunk
+	k          uint64 // chunks per group
+
+	chunks  map[uint64][]byte // chunks received, of groups not yet settled
+	next    uint64            // sequence number of the next chunk to read
+	settled uint64            // sequence number of the first unsettled chunk
+	seen    uint64            // sequence number following any chunk seen
+	chunk   []byte
+	off     int
+	err     error // returned once all chunks before it are read
+}
+
+// NewDatagramDecoder given a source of datagrams holding an encoded stream.
+// Options are requirements, just as with a Decoder.
+func NewDatagramDecoder(s io.Reader, opts ...Option) *DatagramDecoder {
+	return &DatagramDecoder{
+		s:      s,
+		config: newConfig(opts),
+		chunks: make(map[uint64][]byte),
+	}
+}
+
+// Read and decode bytes from the stream. Returns a *LostChunkError in place
+// of each chunk which is lost, io.EOF once the stream's terminator arrives,
+// io.ErrUnexpectedEOF if the datagrams end without one, or a *RemoteError if
+// the producer ended the stream with an error.
+func (dd *DatagramDecoder) Read(p []byte) (n int, err error) {
+	if !dd.readHeader {
+		dd.decodeHeader()
+	}
+
+	for dd.off == len(dd.chunk) {
+		if err = dd.nextChunk(); err != nil {
+			return
+		}
+	}
+
+	n = copy(p, dd.chunk[dd.off:])
+	dd.off += n
+	return
+}
+
+// decodeHeader from the first datagram, and check that the stream can be
+// decoded from datagrams
+func (dd *DatagramDecoder) decodeHeader() {
+	dd.readHeader = true
+	dd.dgram = make([]byte, maxDatagram)
+	n, err := dd.s.Read(dd.dgram)
+	if err != nil && err != io.EOF {
+		dd.err = err
+		return
+	}
+
+	dd.fr.r = bytes.NewReader(dd.dgram[:n])
+	if dd.err = dd.fr.readHeader(dd.config); dd.err != nil {
+		return
+	}
+	h := dd.fr.header
+	switch {
+	case !h.has(flagSequenced):
+		dd.err = ErrNotSequenced
+		return
+	case h.has(flagSealed) || h.has(flagChannels) || h.has(flagWindowed) || h.has(flagDeduped):
+		dd.err = ErrIncompatible
+		return
+	case dd.config.publicKey != nil || h.parity > maxParity:
+		dd.err = ErrIncompatible
+		return
+	}
+
+	dd.fr.gaps = true
+	dd.start, dd.k = h.start.Sequence, 1
+	if h.has(flagParity) {
+		dd.k = uint64(h.parity)
+	}
+	dd.next, dd.settled, dd.seen = dd.start, dd.start, dd.start
+	if n := maxFrameHeaderLen + dd.fr.maxPayload() + checksumSize; n > len(dd.dgram) {
+		dd.dgram = make([]byte, n)
+	}
+}
+
+// nextChunk makes the chunk with the next sequence number current,
+// receiving datagrams until it arrives or is known to be lost
+func (dd *DatagramDecoder) nextChunk() error {
+	for {
+		if chunk, ok := dd.chunks[dd.next]; ok {
+			dd.chunk, dd.off = chunk, 0
+			dd.next++
+			dd.prune()
+			return nil
+		}
+		if dd.next < dd.settled {
+			dd.next++
+			dd.prune()
+			return &LostChunkError{Sequence: dd.next - 1}
+		}
+		if dd.err != nil {
+			return dd.err
+		}
+		dd.receive()
+	}
+}
+
+// receive the next datagram and decode the frame it holds
+func (dd *DatagramDecoder) receive() {
+	n, err := dd.s.Read(dd.dgram)
+	if n > 0 {
+		r := bytes.NewReader(dd.dgram[:n])
+		dd.fr.seek(r, 0, 0, 0)
+		if f, ferr := dd.fr.ReadFrame(); ferr == nil && r.Len() == 0 {
+			dd.decodeFrame(f)
+		}
+	}
+	if err != nil && dd.err == nil {
+		dd.finish(unexpected(err))
+	}
+}
+
+// decodeFrame received as a datagram. Since datagrams arrive in order, a
+// chunk settles every group before its own.
+func (dd *DatagramDecoder) decodeFrame(f Frame) {
+	switch f.Type {
+	case FrameData:
+		if f.Sequence < dd.settled || dd.beyond(f.Sequence) {
+			return
+		}
+		chunk, err := dd.fr.Data(f)
+		if err != nil {
+			return
+		}
+		dd.chunks[f.Sequence] = append([]byte(nil), chunk...)
+		dd.see(f.Sequence + 1)
+		dd.settle(dd.start + (f.Sequence-dd.start)/dd.k*dd.k)
+	case FrameParity:
+		dd.decodeParity(f.Payload)
+	case FrameEnd:
+		dd.finish(io.EOF)
+	case FrameError:
+		if re, ok := parseRemoteError(f.Payload); ok {
+			dd.finish(re)
+		}
+	}
+}
+
+// decodeParity of a group, reconstructing its chunk which was lost if there
+// is just one, and settling the group
+func (dd *DatagramDecoder) decodeParity(p []byte) {
+	first, count, length, data, ok := parseParity(p)
+	switch {
+	case !ok || count == 0 || count > dd.k || first < dd.settled || dd.beyond(first):
+		return
+	case (first-dd.start)%dd.k != 0:
+		return
+	}
+
+	var lost int
+	var missing uint64
+	for s := first; s < first+count; s++ {
+		chunk, ok := dd.chunks[s]
+		if !ok {
+			lost, missing = lost+1, s
+			continue
+		}
+		if len(chunk) > len(data) {
+			return
+		}
+		xor(data, chunk)
+		length ^= uint64(len(chunk))
+	}
+	if lost == 1 && length <= uint64(len(data)) {
+		dd.chunks[missing] = append([]byte(nil), data[:length]...)
+	}
+
+	dd.see(first + count)
+	dd.settle(first + count)
+}
+
+// beyond returns true if a frame with the given sequence number is too far
+// past any chunk seen to be trusted, without a checksum
+func (dd *DatagramDecoder) beyond(sequence uint64) bool {
+	if dd.fr.header.has(flagChecksum) {
+		return sequence > math.MaxUint64-dd.k
+	}
+	return sequence > dd.seen && sequence-dd.seen >= maxGroupsAhead*dd.k
+}
+
+// finish the stream with the given error, settling every chunk seen
+func (dd *DatagramDecoder) finish(err error) {
+	dd.settle(dd.seen)
+	dd.err = err
+}
+
+// see a chunk preceding the given sequence number
+func (dd *DatagramDecoder) see(sequence uint64) {
+	if sequence > dd.seen {
+		dd.seen = sequence
+	}
+}
+
+// settle all chunks preceding the given sequence number, which have either
+// been received or are lost
+func (dd *DatagramDecoder) settle(sequence uint64) {
+	if sequence > dd.settled {
+		dd.settled = sequence
+	}
+}
+
+// prune chunks which have been read and whose group is settled
+func (dd *DatagramDecoder) prune() {
+	for s := range dd.chunks {
+		if s < dd.next && s < dd.settled {
+			delete(dd.chunks, s)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// datagrams records each Write as a datagram, and returns one per Read
+type datagrams [][]byte
+
+func (dg *datagrams) Write(p []byte) (int, error) {
+	*dg = append(*dg, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (dg *datagrams) Read(p []byte) (int, error) {
+	if len(*dg) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*dg)[0])
+	*dg = (*dg)[1:]
+	return n, nil
+}
+
+// drop the datagrams at the given indices
+func (dg datagrams) drop(indices ...int) *datagrams {
+	var kept datagrams
+	for i, d := range dg {
+		dropped := false
+		for _, j := range indices {
+			dropped = dropped || i == j
+		}
+		if !dropped {
+			kept = append(kept, d)
+		}
+	}
+	return &kept
+}
+
+// readDatagrams until an error other than a *LostChunkError, returning the
+// data read and the sequence numbers of lost chunks
+func readDatagrams(dd *DatagramDecoder) (out []byte, lost []uint64, err error) {
+	buf := make([]byte, CHUNK_SIZE/3)
+	for {
+		n, err := dd.Read(buf)
+		out = append(out, buf[:n]...)
+		if lce, ok := err.(*LostChunkError); ok {
+			lost = append(lost, lce.Sequence)
+		} else if err != nil {
+			return out, lost, err
+		}
+	}
+}
+
+func TestParity(t *testing.T) {
+	Convey("Given a stream with parity every 4 chunks, sent as datagrams", t, func() {
+		in := randomBytes(CHUNK_SIZE*9 + CHUNK_SIZE/2)
+		opts := []Option{WithParity(4), WithChecksum(), WithCompression(Flate)}
+		var dg datagrams
+		e := NewEncoder(&dg, CHUNK_SIZE, opts...)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		// The header, 3 groups of data followed by parity, and the end
+		So(dg, ShouldHaveLength, 1+(4+1)+(4+1)+(2+1)+1)
+		chunk := func(seq int) []byte {
+			return in[seq*CHUNK_SIZE : min(len(in), (seq+1)*CHUNK_SIZE)]
+		}
+
+		Convey("Then a Decoder should skip the parity", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(bytes.Join(dg, nil)), opts...))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("When nothing is lost", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(&dg, opts...))
+
+			Convey("Then all data should be read", func() {
+				So(err, ShouldEqual, io.EOF)
+				So(lost, ShouldBeEmpty)
+				So(out, ShouldResemble, in)
+			})
+		})
+
+		Convey("When a chunk of each group is lost", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(dg.drop(1, 8, 12), opts...))
+
+			Convey("Then they should be reconstructed", func() {
+				So(err, ShouldEqual, io.EOF)
+				So(lost, ShouldBeEmpty)
+				So(out, ShouldResemble, in)
+			})
+		})
+
+		Convey("When two chunks of a group are lost", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(dg.drop(7, 9), opts...))
+
+			Convey("Then both should be reported lost, and the rest read", func() {
+				So(err, ShouldEqual, io.EOF)
+				So(lost, ShouldResemble, []uint64{5, 7})
+				want := append(append(append([]byte(nil), in[:5*CHUNK_SIZE]...), chunk(6)...), in[8*CHUNK_SIZE:]...)
+				So(out, ShouldResemble, want)
+			})
+		})
+
+		Convey("When a chunk is lost along with its group's parity", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(dg.drop(2, 5), opts...))
+
+			Convey("Then it should be reported lost", func() {
+				So(err, ShouldEqual, io.EOF)
+				So(lost, ShouldResemble, []uint64{1})
+				So(out, ShouldResemble, append(append([]byte(nil), chunk(0)...), in[2*CHUNK_SIZE:]...))
+			})
+		})
+
+		Convey("When a datagram is corrupted", func() {
+			dg[3][len(dg[3])-1] ^= 1
+			out, lost, err := readDatagrams(NewDatagramDecoder(&dg, opts...))
+
+			Convey("Then it should be dropped and its chunk reconstructed", func() {
+				So(err, ShouldEqual, io.EOF)
+				So(lost, ShouldBeEmpty)
+				So(out, ShouldResemble, in)
+			})
+		})
+
+		Convey("When the end is lost", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(dg.drop(len(dg)-1), opts...))
+
+			Convey("Then all data should be read before the stream is cut short", func() {
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+				So(lost, ShouldBeEmpty)
+				So(out, ShouldResemble, in)
+			})
+		})
+	})
+
+	Convey("Given a sequenced stream without parity, sent as datagrams", t, func() {
+		in := randomBytes(CHUNK_SIZE * 3)
+		var dg datagrams
+		e := NewEncoder(&dg, CHUNK_SIZE, WithSequence())
+		e.Write(in)
+		So(e.CloseWithError(io.ErrClosedPipe), ShouldBeNil)
+
+		Convey("Then lost chunks should be reported", func() {
+			out, lost, err := readDatagrams(NewDatagramDecoder(dg.drop(2)))
+			So(err, ShouldHaveSameTypeAs, &RemoteError{})
+			So(lost, ShouldResemble, []uint64{1})
+			So(out, ShouldResemble, append(in[:CHUNK_SIZE:CHUNK_SIZE], in[2*CHUNK_SIZE:]...))
+		})
+
+		Convey("Then a datagram for a chunk far ahead should be dropped", func() {
+			var far datagrams
+			e := NewEncoder(&far, CHUNK_SIZE, WithSequence(), WithResume(Checkpoint{Sequence: 1 << 40}))
+			e.Write(in[:CHUNK_SIZE])
+			So(e.Close(), ShouldBeNil)
+
+			forged := append(dg[:2:2], far[1])
+			forged = append(forged, dg[2:]...)
+			out, lost, err := readDatagrams(NewDatagramDecoder(&forged))
+			So(err, ShouldHaveSameTypeAs, &RemoteError{})
+			So(lost, ShouldBeEmpty)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then a DatagramDecoder requiring parity should refuse it", func() {
+			_, err := NewDatagramDecoder(&dg, WithParity(4)).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNoParity)
+		})
+	})
+
+	Convey("Given a stream with more chunks per group than a DatagramDecoder accepts", t, func() {
+		var dg datagrams
+		e := NewEncoder(&dg, CHUNK_SIZE, WithParity(maxParity+1))
+		e.Write(randomBytes(CHUNK_SIZE))
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a DatagramDecoder should refuse it", func() {
+			_, err := NewDatagramDecoder(&dg).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrIncompatible)
+		})
+	})
+
+	Convey("Given a stream without sequence numbers", t, func() {
+		var dg datagrams
+		e := NewEncoder(&dg, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE))
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a DatagramDecoder should refuse it", func() {
+			_, err := NewDatagramDecoder(&dg).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNotSequenced)
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// RemoteError reports a producer which failed midway through a stream, and
+// ended it with CloseWithError instead of Close. Data decoded before it is
+// intact, but the stream is incomplete.
+type RemoteError struct {
+	Code    uint64 // application defined, 0 unless given by the producer
+	Message string // error message of the producer
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Message)
+}
+
+// newRemoteError describing the given error. A *RemoteError keeps its code,
+// so errors can be passed along from one stream to the next.
+func newRemoteError(err error) *RemoteError {
+	var re *RemoteError
+	if errors.As(err, &re) {
+		return re
+	}
+	return &RemoteError{Message: err.Error()}
+}
+
+// appendTo the given payload as the code followed by as much of the message
+// as fits within max bytes
+func (e *RemoteError) appendTo(b []byte, max int) []byte {
+	b = binary.AppendUvarint(b, e.Code)
+	msg := e.Message
+	if room := max - len(b); len(msg) > room {
+		// Cut the message between characters
+		for room > 0 && !utf8.RuneStart(msg[room]) {
+			room--
+		}
+		msg = msg[:room]
+	}
+	return append(b, msg...)
+}
+
+// parseRemoteError from the payload of an error frame
+func parseRemoteError(p []byte) (*RemoteError, bool) {
+	code, n := binary.Uvarint(p)
+	if n <= 0 {
+		return nil, false
+	}
+	return &RemoteError{Code: code, Message: string(p[n:])}, true
+}
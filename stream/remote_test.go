@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRemoteError(t *testing.T) {
+	Convey("Given a stream closed with an error midway", t, func() {
+		in := randomBytes(CHUNK_SIZE*2 + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithChecksum(), WithAEAD(newAEAD(testKey)))
+		e.Write(in)
+		So(e.CloseWithError(errors.New("disk on fire")), ShouldBeNil)
+
+		Convey("Then the data before it should decode, followed by the error", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, WithAEAD(newAEAD(testKey))))
+			So(out, ShouldResemble, in)
+			So(err, ShouldResemble, &RemoteError{Message: "disk on fire"})
+		})
+
+		Convey("Then the Encoder should be closed", func() {
+			So(e.Close(), ShouldEqual, ErrClosedEncoder)
+		})
+	})
+
+	Convey("Given a stream closed with a RemoteError and a long message", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		msg := strings.Repeat("ä", CHUNK_SIZE)
+		So(e.CloseWithError(&RemoteError{Code: 42, Message: msg}), ShouldBeNil)
+
+		Convey("Then the code should be kept and the message cut to fit", func() {
+			_, err := NewDecoder(&s).Read(make([]byte, 1))
+			So(err, ShouldHaveSameTypeAs, &RemoteError{})
+
+			re := err.(*RemoteError)
+			So(re.Code, ShouldEqual, 42)
+			So(strings.HasPrefix(msg, re.Message), ShouldBeTrue)
+			So(len(re.Message), ShouldBeLessThan, CHUNK_SIZE)
+			So(len(re.Message)%len("ä"), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a message stream closed with an error", t, func() {
+		var s bytes.Buffer
+		me := NewMessageEncoder(&s, CHUNK_SIZE, CHUNK_SIZE)
+		So(me.WriteMessage([]byte("first")), ShouldBeNil)
+		So(me.CloseWithError(io.ErrShortWrite), ShouldBeNil)
+
+		Convey("Then the error should follow the last message", func() {
+			md := NewMessageDecoder(&s, CHUNK_SIZE)
+			msg, err := md.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(msg), ShouldEqual, "first")
+
+			_, err = md.ReadMessage()
+			So(err, ShouldResemble, &RemoteError{Message: io.ErrShortWrite.Error()})
+		})
+	})
+}
@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotSequenced   = errors.New("stream has no sequence numbers")
+	ErrResumeMismatch = errors.New("stream doesn't resume from the expected checkpoint")
+)
+
+// Checkpoint is a position within a sequenced stream, such as how far a
+// receiver has durably processed it. A transfer which broke off can resume
+// from there with a new stream, rather than from the start.
+type Checkpoint struct {
+	Sequence uint64 // sequence number of the chunk holding the next byte
+	Offset   int64  // decoded offset of the next byte
+}
+
+// NewResumedEncoder starts a new stream resuming from the given Checkpoint
+// of an earlier one. The source of the earlier stream must be replayable,
+// and is seeked to the Checkpoint's offset, so copying the rest of it into
+// the Encoder completes the transfer.
+func NewResumedEncoder(s io.Writer, size int, src io.Seeker, cp Checkpoint, opts ...Option) (*Encoder, error) {
+	if _, err := src.Seek(cp.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	opts = append(opts[:len(opts):len(opts)], WithResume(cp))
+	return NewEncoder(s, size, opts...), nil
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	Convey("Given a sequenced transfer which breaks off midway", t, func() {
+		in := randomBytes(CHUNK_SIZE*6 + CHUNK_SIZE/4)
+		opts := []Option{WithSequence(), WithChecksum()}
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, opts...)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+		s.Truncate(s.Len() / 2)
+
+		d := NewDecoder(&s, opts...)
+		received := make([]byte, CHUNK_SIZE*2+CHUNK_SIZE/3)
+		_, err := io.ReadFull(d, received)
+		So(err, ShouldBeNil)
+
+		cp := d.Checkpoint()
+		So(cp, ShouldResemble, Checkpoint{Sequence: 2, Offset: int64(len(received))})
+
+		Convey("When a new Encoder resumes from the receiver's checkpoint", func() {
+			var r bytes.Buffer
+			e, err := NewResumedEncoder(&r, CHUNK_SIZE, bytes.NewReader(in), cp, WithChecksum())
+			So(err, ShouldBeNil)
+			_, err = e.ReadFrom(bytes.NewReader(in[cp.Offset:]))
+			So(err, ShouldBeNil)
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then the rest of the data should complete the transfer", func() {
+				d := NewDecoder(&r, WithResume(cp))
+				rest, err := ioutil.ReadAll(d)
+				So(err, ShouldBeNil)
+				So(append(received, rest...), ShouldResemble, in)
+				So(d.Checkpoint(), ShouldResemble, Checkpoint{Sequence: 2 + 4, Offset: int64(len(in))})
+			})
+
+			Convey("Then a receiver expecting another checkpoint should refuse it", func() {
+				_, err := NewDecoder(&r, WithResume(Checkpoint{Sequence: 3})).Read(make([]byte, 1))
+				So(err, ShouldEqual, ErrResumeMismatch)
+			})
+		})
+	})
+
+	Convey("Given a sequenced stream with a chunk left out", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithSequence(), WithChecksum())
+		e.Write(randomBytes(CHUNK_SIZE * 3))
+		So(e.Close(), ShouldBeNil)
+
+		enc := s.Bytes()
+		frame := frameHeaderLen(CHUNK_SIZE) + 1 + CHUNK_SIZE + checksumSize
+		start := len(enc) - 3*frame - frameHeaderLen(0) - checksumSize
+		enc = append(enc[:start+frame:start+frame], enc[start+2*frame:]...)
+
+		Convey("Then the decoder should notice the gap", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc)))
+			So(out, ShouldHaveLength, CHUNK_SIZE)
+			So(err, ShouldResemble, &CorruptionError{Frame: 1, Chunk: 1, Offset: int64(start + frame)})
+		})
+	})
+
+	Convey("Given a stream without sequence numbers", t, func() {
+		in := randomBytes(CHUNK_SIZE * 2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a checkpoint taken midway through a chunk should be zero", func() {
+			d := NewDecoder(&s)
+			So(readN(d, CHUNK_SIZE+CHUNK_SIZE/2), ShouldBeNil)
+			So(d.Checkpoint(), ShouldResemble, Checkpoint{})
+		})
+
+		Convey("Then a decoder requiring them should refuse it", func() {
+			_, err := NewDecoder(&s, WithSequence()).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNotSequenced)
+		})
+	})
+}
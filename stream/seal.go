@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// counterSize is the length of the frame counter ending every nonce. The
+// rest of the nonce is a random prefix chosen per stream.
+const counterSize = 4
+
+var (
+	ErrNoKey         = errors.New("stream is sealed, but no key was given")
+	ErrNotSealed     = errors.New("stream is not sealed")
+	ErrFrameOverflow = errors.New("too many frames to seal in one stream")
+)
+
+// sealer encrypts and authenticates frame payloads. Each frame's nonce ends
+// with its index in the stream, so any reordering, replay or removal of
+// frames fails authentication.
+type sealer struct {
+	aead   cipher.AEAD
+	nonce  []byte
+	header []byte // encoded stream header, authenticated with every frame
+}
+
+// newSealer using the given nonce prefix, or a random one if it's nil
+func newSealer(aead cipher.AEAD, prefix []byte) (*sealer, error) {
+	if aead.NonceSize() <= counterSize {
+		return nil, errors.New("AEAD nonce too short to seal a stream")
+	}
+
+	s := &sealer{aead: aead, nonce: make([]byte, aead.NonceSize())}
+	if prefix == nil {
+		if _, err := rand.Read(s.nonce[:len(s.nonce)-counterSize]); err != nil {
+			return nil, err
+		}
+	} else if copy(s.nonce, prefix) != len(s.nonce)-counterSize {
+		return nil, ErrIncompatible
+	}
+	return s, nil
+}
+
+// authenticate the given stream header along with every frame, if its
+// version calls for it
+func (s *sealer) authenticate(h header) {
+	if h.version >= sealedHeaderVersion {
+		s.header = h.bytes()
+	}
+}
+
+// prefix of all nonces, which must be shared with the opening side
+func (s *sealer) prefix() []byte {
+	return s.nonce[:len(s.nonce)-counterSize]
+}
+
+// counter sets the nonce for the frame with the given index
+func (s *sealer) counter(index int64) error {
+	if index > math.MaxUint32 {
+		return ErrFrameOverflow
+	}
+	binary.BigEndian.PutUint32(s.nonce[len(s.nonce)-counterSize:], uint32(index))
+	return nil
+}
+
+// seal the payload of the frame with the given index, appending it to dst.
+// The additional data authenticates the frame's metadata.
+func (s *sealer) seal(dst, payload, ad []byte, index int64) ([]byte, error) {
+	if err := s.counter(index); err != nil {
+		return dst, err
+	}
+	return s.aead.Seal(dst, s.nonce, payload, ad), nil
+}
+
+// open a sealed payload of the frame with the given index in place
+func (s *sealer) open(sealed, ad []byte, index int64) ([]byte, error) {
+	if err := s.counter(index); err != nil {
+		return nil, err
+	}
+	return s.aead.Open(sealed[:0], s.nonce, sealed, ad)
+}
@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrClosedSession = errors.New("closed session")
+
+// minWindow is the smallest window a Session allows, leaving room for
+// chunks larger than acknowledgements
+const minWindow = 64
+
+// Session pairs the encoding and decoding of a bidirectional stream, such
+// as a network connection, with flow control. Each side acknowledges the
+// data it has consumed, and a writer may have at most a window of bytes
+// in flight without acknowledgement. Producers are thereby held back by
+// the actual progress of the consumer on the other side.
+type Session struct {
+	rw     io.ReadWriter
+	size   int
+	window int
+
+	wlock sync.Mutex // serializes frames written to the stream
+	fw    FrameWriter
+
+	lock     sync.Mutex // guards everything below
+	cond     *sync.Cond // signals incoming data and acknowledgements
+	buf      []byte     // incoming data not yet read
+	consumed int64      // incoming bytes read so far
+	acked    int64      // consumed bytes last acknowledged
+	ackEvery int64      // consumed bytes between acknowledgements
+	sent     int64      // outgoing bytes written so far
+	received int64      // outgoing bytes acknowledged by the other side
+	err      error      // error ending the incoming stream
+	closed   bool
+}
+
+// NewSession starts a session over the given stream, writing chunks of the
+// given size. At most window bytes are sent before the other side
+// acknowledges them, and chunks are made small enough to fit half the
+// window. Options work as they do for NewMux.
+func NewSession(rw io.ReadWriter, size, window int, opts ...Option) *Session {
+	if window < minWindow {
+		window = minWindow
+	}
+	c := newConfig(opts)
+	c.window = window
+
+	// Chunks must fit in half a window, so acknowledging every half window
+	// never leaves a writer waiting for a chunk that would fit
+	if size > window/2 {
+		size = window / 2
+	}
+
+	s := &Session{rw: rw, size: size, window: window}
+	s.cond = sync.NewCond(&s.lock)
+
+	var err error
+	if s.fw, err = newFrameWriter(rw, size, c); err != nil {
+		s.err = err
+		return s
+	}
+
+	go s.readLoop(c)
+	return s
+}
+
+// Read data sent by the other side, acknowledging it once enough has been
+// consumed. Returns io.EOF after the other side closed the session.
+func (s *Session) Read(p []byte) (n int, err error) {
+	s.lock.Lock()
+	for len(s.buf) == 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	switch {
+	case len(s.buf) > 0:
+		n = copy(p, s.buf)
+		s.buf = s.buf[n:]
+		s.consumed += int64(n)
+	case s.closed:
+		err = ErrClosedSession
+	default:
+		err = s.err
+	}
+
+	// Acknowledge consumed data every half window of the other side
+	var ack int64 = -1
+	if s.consumed-s.acked >= s.ackEvery && s.ackEvery > 0 {
+		ack, s.acked = s.consumed, s.consumed
+	}
+	s.lock.Unlock()
+
+	if ack >= 0 {
+		if aerr := s.ack(ack); err == nil {
+			err = aerr
+		}
+	}
+	return
+}
+
+// Write data to the other side, blocking while the window is full
+func (s *Session) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		sz := len(p) - n
+		if sz > s.size {
+			sz = s.size
+		}
+		if err = s.reserve(sz); err != nil {
+			return
+		}
+
+		s.wlock.Lock()
+		err = s.fw.writeData(0, p[n:n+sz])
+		s.wlock.Unlock()
+		if err != nil {
+			return
+		}
+		n += sz
+	}
+	return
+}
+
+// Unacknowledged is the number of bytes sent, but not yet acknowledged by
+// the other side
+func (s *Session) Unacknowledged() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sent - s.received
+}
+
+// Close the session, ending the outgoing stream. This also closes the
+// underlying stream if possible.
+func (s *Session) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	s.wlock.Lock()
+	err := s.fw.WriteFrame(Frame{Type: FrameEnd})
+	s.wlock.Unlock()
+
+	if closer, ok := s.rw.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// reserve room in the window for the given number of bytes, waiting for
+// acknowledgements if necessary
+func (s *Session) reserve(sz int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for s.sent-s.received+int64(sz) > int64(s.window) && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	switch {
+	case s.closed:
+		return ErrClosedSession
+	case s.err == io.EOF:
+		return io.ErrClosedPipe
+	case s.err != nil:
+		return s.err
+	}
+
+	s.sent += int64(sz)
+	return nil
+}
+
+// ack tells the other side how much of its data has been consumed
+func (s *Session) ack(consumed int64) error {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(consumed))
+
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	return s.fw.WriteFrame(Frame{Type: FrameAck, Payload: b[:n]})
+}
+
+// readLoop decodes the incoming stream, buffering data and taking note of
+// acknowledgements
+func (s *Session) readLoop(c config) {
+	err := readPeer(s.rw, c, flagWindowed, s.start, s.handle)
+
+	s.lock.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// start acknowledging every half window of the other side
+func (s *Session) start(h header) {
+	s.lock.Lock()
+	s.ackEvery = int64(h.window / 2)
+	s.lock.Unlock()
+}
+
+// handle an incoming frame
+func (s *Session) handle(fr *FrameReader, f Frame) error {
+	switch f.Type {
+	case FrameData:
+		chunk, err := fr.Data(f)
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.buf = append(s.buf, chunk...)
+		s.cond.Broadcast()
+		s.lock.Unlock()
+		return nil
+	case FrameAck:
+		received, n := binary.Uvarint(f.Payload)
+		if n <= 0 {
+			return fr.corrupt()
+		}
+		s.lock.Lock()
+		if int64(received) > s.received && int64(received) <= s.sent {
+			s.received = int64(received)
+			s.cond.Broadcast()
+		}
+		s.lock.Unlock()
+		return nil
+	}
+	return ErrIncompatible
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	const WINDOW = CHUNK_SIZE * 4
+
+	Convey("Given two Sessions connected to each other", t, func() {
+		a, b := net.Pipe()
+		sa, sb := NewSession(a, CHUNK_SIZE, WINDOW), NewSession(b, CHUNK_SIZE, WINDOW)
+
+		Convey("When one side writes much more than a window", func() {
+			in := randomBytes(WINDOW * 10)
+			written := make(chan error, 1)
+			go func() {
+				_, err := sa.Write(in)
+				written <- err
+			}()
+
+			Convey("Then the writer should block once the window is full", func() {
+				select {
+				case <-written:
+					So(false, ShouldBeTrue)
+				case <-time.After(10 * time.Millisecond):
+				}
+				So(sa.Unacknowledged(), ShouldEqual, WINDOW)
+			})
+
+			Convey("Then the reader should get it all, without exceeding the window", func() {
+				out := make([]byte, len(in))
+				for n := 0; n < len(out); {
+					m, err := sb.Read(out[n:min(n+CHUNK_SIZE/3, len(out))])
+					So(err, ShouldBeNil)
+					So(sa.Unacknowledged(), ShouldBeLessThanOrEqualTo, WINDOW)
+					n += m
+				}
+				So(out, ShouldResemble, in)
+				So(<-written, ShouldBeNil)
+			})
+		})
+
+		Convey("When one side closes the session", func() {
+			So(sa.Close(), ShouldBeNil)
+
+			Convey("Then the other side should read EOF", func() {
+				_, err := sb.Read(make([]byte, 1))
+				So(err, ShouldEqual, io.EOF)
+			})
+		})
+
+		Reset(func() {
+			sa.Close()
+			sb.Close()
+		})
+	})
+}
@@ -0,0 +1,195 @@
+package stream
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// signatureContext prefixes every message signed for a stream, so that
+// signatures made with the same key for anything else never verify
+const signatureContext = "moreio stream signature\x00"
+
+// maxSignaturePayload is the longest payload of a signature frame: the
+// number of chunks signed, whether the signature is final, and the
+// signature itself
+const maxSignaturePayload = binary.MaxVarintLen64 + 1 + ed25519.SignatureSize
+
+var (
+	ErrNotSigned = errors.New("stream isn't signed")
+	ErrSignature = errors.New("stream signature missing or invalid")
+)
+
+// chain of digests covering the header and every chunk of a stream, so a
+// signature of its head covers all of them
+type chain struct {
+	head   [sha256.Size]byte
+	chunks uint64 // chunks covered
+	hash   hash.Hash
+}
+
+// newChain starting with the digest of the given header
+func newChain(h header) chain {
+	return chain{head: sha256.Sum256(h.bytes()), hash: sha256.New()}
+}
+
+// add a chunk to the chain, or the payload of a frame of another type
+func (c *chain) add(typ FrameType, p []byte) {
+	c.hash.Reset()
+	c.hash.Write(c.head[:])
+	c.hash.Write([]byte{byte(typ)})
+	c.hash.Write(p)
+	c.hash.Sum(c.head[:0])
+	if typ == FrameData {
+		c.chunks++
+	}
+}
+
+// message signed for the chain's current head. A final signature is the
+// last of the stream.
+func (c *chain) message(final bool) []byte {
+	b := append([]byte(signatureContext), c.head[:]...)
+	b = binary.BigEndian.AppendUint64(b, c.chunks)
+	if final {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// signer signs the chain of an Encoder's stream
+type signer struct {
+	key      ed25519.PrivateKey
+	every    int
+	chain    chain
+	unsigned int // chunks added since the last signature
+}
+
+// add a chunk, or the payload of a frame of another type, to the chain.
+// Returns true once a signature is due.
+func (s *signer) add(typ FrameType, p []byte) bool {
+	s.chain.add(typ, p)
+	if held(typ) {
+		s.unsigned++
+	}
+	return s.unsigned >= s.every
+}
+
+// sign the chain's head, if anything was added since the last signature or
+// the signature is final. Must be called with the lock held.
+func (e *Encoder) sign(final bool) error {
+	s := e.signer
+	if s == nil || s.unsigned == 0 && !final {
+		return nil
+	}
+	s.unsigned = 0
+
+	payload := binary.AppendUvarint(nil, s.chain.chunks)
+	if final {
+		payload = append(payload, 1)
+	} else {
+		payload = append(payload, 0)
+	}
+	payload = append(payload, ed25519.Sign(s.key, s.chain.message(final))...)
+	return e.fw.WriteFrame(Frame{Type: FrameSignature, Payload: payload})
+}
+
+// held returns true for frames which a verifier holds back, and so count
+// towards the next signature: chunks, and custom frames
+func held(typ FrameType) bool {
+	return typ == FrameData || typ.custom()
+}
+
+// heldChunk is a chunk, or the payload of a custom frame, which can't be
+// read before it's verified
+type heldChunk struct {
+	typ      FrameType
+	chunk    []byte
+	sequence uint64
+}
+
+// verifier holds back the chunks of a Decoder's stream until a signature
+// covering them is verified
+type verifier struct {
+	key      ed25519.PublicKey
+	every    int
+	chain    chain
+	held     []heldChunk // chained, but not yet signed
+	verified []heldChunk // signed, but not yet read
+	final    bool        // whether the last signature was final
+}
+
+// newVerifier for the stream with the given header
+func newVerifier(key ed25519.PublicKey, h header) *verifier {
+	return &verifier{key: key, every: h.signEvery, chain: newChain(h)}
+}
+
+// hold a copy of a chunk until it's verified
+func (v *verifier) hold(chunk []byte, sequence uint64) error {
+	if err := v.add(FrameData, chunk); err != nil {
+		return err
+	}
+	return v.keep(heldChunk{FrameData, append([]byte(nil), chunk...), sequence})
+}
+
+// holdFrame holds a copy of a custom frame until it's verified
+func (v *verifier) holdFrame(f Frame) error {
+	if err := v.add(f.Type, f.Payload); err != nil {
+		return err
+	}
+	return v.keep(heldChunk{f.Type, append([]byte(nil), f.Payload...), 0})
+}
+
+// keep what's held until the next signature
+func (v *verifier) keep(hc heldChunk) error {
+	v.held = append(v.held, hc)
+
+	// The Encoder signs every so many chunks, which bounds what's held
+	if len(v.held) > v.every {
+		return ErrSignature
+	}
+	return nil
+}
+
+// add a chunk, or the payload of a frame of another type, to the chain
+func (v *verifier) add(typ FrameType, p []byte) error {
+	if v.final {
+		return ErrSignature
+	}
+	v.chain.add(typ, p)
+	return nil
+}
+
+// verify the payload of a signature frame against the chain, releasing the
+// chunks it covers
+func (v *verifier) verify(p []byte) error {
+	chunks, n := binary.Uvarint(p)
+	switch {
+	case n <= 0 || len(p[n:]) != 1+ed25519.SignatureSize || p[n] > 1:
+		return ErrSignature
+	case chunks != v.chain.chunks || v.final:
+		return ErrSignature
+	}
+
+	final := p[n] == 1
+	if len(v.key) != ed25519.PublicKeySize || !ed25519.Verify(v.key, v.chain.message(final), p[n+1:]) {
+		return ErrSignature
+	}
+	v.verified = append(v.verified, v.held...)
+	v.held = v.held[:0]
+	v.final = final
+	return nil
+}
+
+// next verified chunk or custom frame
+func (v *verifier) next() heldChunk {
+	hc := v.verified[0]
+	v.verified = v.verified[1:]
+	return hc
+}
+
+// complete returns true if the whole stream was verified
+func (v *verifier) complete() bool {
+	return v.final && len(v.held) == 0
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSigning(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+
+	Convey("Given a stream signed every 3 chunks", t, func() {
+		in := randomBytes(CHUNK_SIZE*7 + CHUNK_SIZE/2)
+		opts := []Option{WithSigning(key, 3), WithTrailer(), WithSequence(), WithIndex(), WithCompression(Flate)}
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, opts...)
+		e.Write(in)
+		So(e.SetTrailer("artifact", "test"), ShouldBeNil)
+		So(e.Close(), ShouldBeNil)
+		enc := s.Bytes()
+
+		Convey("Then it should verify against the public key", func() {
+			d := NewDecoder(bytes.NewReader(enc), WithVerification(pub))
+			out, err := ioutil.ReadAll(d)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+			So(d.Trailer().Fields["artifact"], ShouldEqual, "test")
+			So(d.Checkpoint(), ShouldResemble, Checkpoint{Sequence: 8, Offset: int64(len(in))})
+		})
+
+		Convey("Then it should verify with concurrency", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc), WithVerification(pub), WithConcurrency(4)))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then it should decode without the public key", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc)))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+
+		Convey("Then another public key should get no data at all", func() {
+			other, _, _ := ed25519.GenerateKey(nil)
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc), WithVerification(other)))
+			So(out, ShouldBeEmpty)
+			So(err, ShouldEqual, ErrSignature)
+		})
+
+		Convey("Then a SeekableDecoder shouldn't claim to verify it", func() {
+			_, err := NewSeekableDecoder(bytes.NewReader(enc), int64(len(enc)), WithVerification(pub))
+			So(err, ShouldEqual, ErrIncompatible)
+		})
+	})
+
+	Convey("Given a signed stream with a chunk tampered with", t, func() {
+		in := randomBytes(CHUNK_SIZE * 6)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithSigning(key, 3))
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		enc := s.Bytes()
+		enc[bytes.Index(enc, in[4*CHUNK_SIZE:4*CHUNK_SIZE+16])] ^= 1
+
+		Convey("Then no data past the last verified signature should be read", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc), WithVerification(pub)))
+			So(out, ShouldResemble, in[:3*CHUNK_SIZE])
+			So(err, ShouldEqual, ErrSignature)
+		})
+	})
+
+	Convey("Given a signed stream ended early by someone else", t, func() {
+		in := randomBytes(CHUNK_SIZE * 3)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithSigning(key, 3))
+		e.Write(in)
+		So(e.fw.WriteFrame(Frame{Type: FrameEnd}), ShouldBeNil)
+
+		Convey("Then the end shouldn't be trusted", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, WithVerification(pub)))
+			So(out, ShouldResemble, in)
+			So(err, ShouldEqual, ErrSignature)
+		})
+	})
+
+	Convey("Given a flushed signed stream", t, func() {
+		in := randomBytes(CHUNK_SIZE / 2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithSigning(key, 100))
+		e.Write(in)
+		So(e.Flush(), ShouldBeNil)
+
+		Convey("Then the flushed data should be verified", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, WithVerification(pub)))
+			So(out, ShouldResemble, in)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+	})
+
+	Convey("Given an unsigned stream", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE))
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a decoder expecting signatures should refuse it", func() {
+			_, err := NewDecoder(&s, WithVerification(pub)).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNotSigned)
+		})
+	})
+}
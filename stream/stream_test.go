@@ -2,10 +2,23 @@ package stream
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 const CHUNK_SIZE = 1000
@@ -33,16 +46,20 @@ func TestStream(t *testing.T) {
 
 	for _, tst := range tsts {
 		testStream(t, tst.input, tst.name)
+		testStream(t, tst.input, tst.name+" with checksums", WithChecksum())
+		testStream(t, tst.input, tst.name+" with compression", WithCompression(Flate), WithChecksum())
+		testStream(t, tst.input, tst.name+" sealed", WithAEAD(newAEAD(testKey)), WithCompression(Flate))
+		testStream(t, tst.input, tst.name+" indexed", WithIndex(), WithChecksum())
 	}
 }
 
-func testStream(t *testing.T, in []byte, testName string) {
+func testStream(t *testing.T, in []byte, testName string, opts ...Option) {
 	Convey("Given an input "+testName, t, func() {
 		inr := bytes.NewReader(in)
 		var s bytes.Buffer
 
 		Convey("When it is encoded into a stream", func() {
-			e := NewEncoder(&s, CHUNK_SIZE)
+			e := NewEncoder(&s, CHUNK_SIZE, opts...)
 			n, err := io.Copy(e, inr)
 			So(err, ShouldBeNil)
 			So(n, ShouldEqual, len(in))
@@ -52,14 +69,832 @@ func testStream(t *testing.T, in []byte, testName string) {
 
 			Convey("Then it should be decoded and read out intact", func() {
 				var out bytes.Buffer
-				d := NewDecoder(&s, CHUNK_SIZE)
+				d := NewDecoder(&s, opts...)
 				_, err := io.Copy(&out, d)
 
 				So(out.Bytes(), ShouldResemble, in)
 				So(err, ShouldBeNil)
 			})
 		})
+
+		Convey("When it is encoded from a reader returning a byte at a time", func() {
+			e := NewEncoder(&s, CHUNK_SIZE, opts...)
+			n, err := e.ReadFrom(iotest.OneByteReader(inr))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(in))
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then it should be decoded and read out intact", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&s, opts...))
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+		})
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	Convey("Given a stream of a few chunks encoded with checksums", t, func() {
+		in := randomBytes(CHUNK_SIZE*3 + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithChecksum())
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("When a bit of the third chunk's data is flipped", func() {
+			frame := frameHeaderLen(CHUNK_SIZE) + CHUNK_SIZE + checksumSize
+			enc := s.Bytes()
+			enc[headerSize+2*frame+frameHeaderLen(CHUNK_SIZE)+CHUNK_SIZE/2] ^= 0x10
+
+			Convey("Then the decoder should report the corrupt chunk", func() {
+				d := NewDecoder(bytes.NewReader(enc), WithChecksum())
+				out, err := ioutil.ReadAll(d)
+
+				So(out, ShouldResemble, in[:2*CHUNK_SIZE])
+				So(err, ShouldResemble, &CorruptionError{Frame: 2, Chunk: 2, Offset: int64(headerSize + 2*frame)})
+			})
+		})
+	})
+
+	Convey("Given a stream with heartbeats between its chunks", t, func() {
+		in := randomBytes(CHUNK_SIZE * 3)
+		var s bytes.Buffer
+		fw, err := NewFrameWriter(&s, CHUNK_SIZE, WithChecksum(), WithCompression(Flate))
+		So(err, ShouldBeNil)
+		var offset int
+		for i := 0; i < 3; i++ {
+			So(fw.WriteFrame(Frame{Type: FrameHeartbeat}), ShouldBeNil)
+			So(fw.WriteFrame(Frame{Type: FrameHeartbeat}), ShouldBeNil)
+			offset = s.Len()
+			So(fw.WriteChunk(in[i*CHUNK_SIZE:(i+1)*CHUNK_SIZE]), ShouldBeNil)
+		}
+		So(fw.WriteFrame(Frame{Type: FrameEnd}), ShouldBeNil)
+
+		Convey("When a bit of the third chunk is flipped", func() {
+			enc := s.Bytes()
+			enc[offset+frameHeaderLen(CHUNK_SIZE)+CHUNK_SIZE/2] ^= 0x10
+			want := &CorruptionError{Frame: 8, Chunk: 2, Offset: int64(offset)}
+
+			Convey("Then the decoder should report the index of the chunk as well as the frame", func() {
+				_, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc)))
+				So(err, ShouldResemble, want)
+			})
+
+			Convey("Then a decoder decompressing in parallel should report the same", func() {
+				_, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc), WithConcurrency(4)))
+				So(err, ShouldResemble, want)
+			})
+		})
+	})
+}
+
+func TestTerminator(t *testing.T) {
+	Convey("Given a stream of exactly a few chunks", t, func() {
+		in := randomBytes(CHUNK_SIZE * 3)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Close should add no empty chunk, only a terminator", func() {
+			So(s.Len(), ShouldEqual, headerSize+3*(frameHeaderLen(CHUNK_SIZE)+CHUNK_SIZE)+frameHeaderLen(0))
+		})
+
+		Convey("When the terminator is cut off", func() {
+			s.Truncate(s.Len() - frameHeaderLen(0))
+
+			Convey("Then all data should be read, followed by an unexpected EOF", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&s))
+				So(out, ShouldResemble, in)
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+
+		Convey("When the stream is cut off mid-chunk", func() {
+			s.Truncate(headerSize + frameHeaderLen(CHUNK_SIZE) + CHUNK_SIZE/2)
+
+			Convey("Then an unexpected EOF should be returned", func() {
+				_, err := ioutil.ReadAll(NewDecoder(&s))
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+	})
+}
+
+func TestCompression(t *testing.T) {
+	in := bytes.Repeat([]byte("compressible log line\n"), CHUNK_SIZE)
+
+	for _, codec := range []Codec{Flate, Gzip} {
+		testStream(t, in, "of compressible data", WithCompression(codec))
+	}
+	testStream(t, in, "of compressible data compressed in parallel",
+		WithCompression(Flate), WithConcurrency(4), WithTrailer(), WithAEAD(newAEAD(testKey)))
+
+	Convey("Given compressible data encoded with compression", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithCompression(Flate))
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("The encoded stream should be much smaller than the data", func() {
+			So(s.Len(), ShouldBeLessThan, len(in)/4)
+		})
+
+		Convey("A decoder decompressing in parallel should find a corrupt chunk", func() {
+			enc := s.Bytes()
+			enc[len(enc)/2] ^= 0xff
+			d := NewDecoder(&s, WithConcurrency(4))
+			_, err := io.Copy(ioutil.Discard, d)
+			So(err, ShouldHaveSameTypeAs, &CorruptionError{})
+		})
+
+		Convey("A decoder decompressing in parallel should stop reading ahead once it fails", func() {
+			var s bytes.Buffer
+			e := NewEncoder(&s, CHUNK_SIZE, WithCompression(Flate))
+			So(e.WriteFrame(mark, nil), ShouldBeNil)
+			e.Write(in)
+			So(e.Close(), ShouldBeNil)
+
+			failed := errors.New("failed")
+			before := settledGoroutines()
+			d := NewDecoder(&s, WithConcurrency(4), WithFrameHandler(mark, func(Frame) error { return failed }))
+			_, err := d.Read(make([]byte, 1))
+			So(err, ShouldEqual, failed)
+			So(goroutinesExit(before), ShouldBeTrue)
+		})
+
+		Convey("A decoder without the stream's codec should refuse it", func() {
+			codecsLock.Lock()
+			delete(codecs, Flate.ID())
+			codecsLock.Unlock()
+
+			_, err := NewDecoder(&s).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrUnknownCodec)
+		})
+
+		Reset(func() {
+			RegisterCodec(Flate)
+		})
+	})
+}
+
+func TestSealing(t *testing.T) {
+	Convey("Given a sealed stream of a few chunks", t, func() {
+		in := randomBytes(CHUNK_SIZE * 3)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithAEAD(newAEAD(testKey)))
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		overhead := newAEAD(testKey).Overhead()
+		frame := frameHeaderLen(CHUNK_SIZE+overhead) + CHUNK_SIZE + overhead
+		start := s.Len() - 3*frame - (frameHeaderLen(overhead) + overhead)
+		enc := s.Bytes()
+
+		Convey("A decoder without the key should refuse it", func() {
+			_, err := NewDecoder(&s).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNoKey)
+		})
+
+		Convey("A decoder with the wrong key should find the first chunk corrupt", func() {
+			key := append([]byte(nil), testKey...)
+			key[0] ^= 1
+			_, err := NewDecoder(&s, WithAEAD(newAEAD(key))).Read(make([]byte, 1))
+			So(err, ShouldResemble, &CorruptionError{Frame: 0, Offset: int64(start)})
+		})
+
+		Convey("When two chunks are swapped", func() {
+			first := append([]byte(nil), enc[start:start+frame]...)
+			copy(enc[start:], enc[start+frame:start+2*frame])
+			copy(enc[start+frame:], first)
+
+			Convey("Then the decoder should refuse the first of them", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&s, WithAEAD(newAEAD(testKey))))
+				So(out, ShouldBeEmpty)
+				So(err, ShouldHaveSameTypeAs, &CorruptionError{})
+			})
+		})
+
+		Convey("When the last chunk is replayed in place of the terminator", func() {
+			s.Truncate(start + 3*frame)
+			s.Write(enc[start+2*frame : start+3*frame])
+
+			Convey("Then the decoder should refuse the replayed chunk", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&s, WithAEAD(newAEAD(testKey))))
+				So(out, ShouldResemble, in)
+				So(err, ShouldResemble, &CorruptionError{Frame: 3, Chunk: 3, Offset: int64(start + 3*frame)})
+			})
+		})
+
+		Convey("When the chunk size in the header is changed", func() {
+			binary.BigEndian.PutUint32(enc[len(magic)+5:], CHUNK_SIZE*2)
+
+			Convey("Then the decoder should find the first chunk corrupt", func() {
+				out, err := ioutil.ReadAll(NewDecoder(&s, WithAEAD(newAEAD(testKey))))
+				So(out, ShouldBeEmpty)
+				So(err, ShouldResemble, &CorruptionError{Frame: 0, Offset: int64(start)})
+			})
+		})
+	})
+
+	Convey("Given a sealed stream in the version 3 format", t, func() {
+		in := randomBytes(CHUNK_SIZE * 2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithAEAD(newAEAD(testKey)))
+		e.fw.header.version = 3
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("It should still be decoded, without authenticating its header", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, WithAEAD(newAEAD(testKey))))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+	})
+}
+
+func TestFlush(t *testing.T) {
+	Convey("Given an encoder with a little data written", t, func() {
+		in := randomBytes(CHUNK_SIZE / 10)
+		var s lockedBuffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithFlushInterval(5*time.Millisecond))
+		e.Write(in)
+
+		Convey("Nothing should be written to the stream yet", func() {
+			So(s.Bytes(), ShouldBeEmpty)
+		})
+
+		Convey("When it's flushed", func() {
+			So(e.Flush(), ShouldBeNil)
+
+			Convey("Then the data should be decoded, without the stream ending", func() {
+				out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(s.Bytes())))
+				So(out, ShouldResemble, in)
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+
+			Convey("Then more data should still be accepted", func() {
+				e.Write(in)
+				So(e.Close(), ShouldBeNil)
+
+				out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(s.Bytes())))
+				So(out, ShouldResemble, append(in, in...))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the flush interval passes", func() {
+			time.Sleep(20 * time.Millisecond)
+
+			Convey("Then the data should have been flushed by itself", func() {
+				out, _ := ioutil.ReadAll(NewDecoder(bytes.NewReader(s.Bytes())))
+				So(out, ShouldResemble, in)
+			})
+		})
+
+		Convey("When it's closed", func() {
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then writing should fail", func() {
+				_, err := e.Write(in)
+				So(err, ShouldEqual, ErrClosedEncoder)
+			})
+		})
+
+		Reset(func() {
+			e.Close()
+		})
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	Convey("Given an idle encoder with heartbeats", t, func() {
+		var s lockedBuffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithHeartbeat(5*time.Millisecond), WithChecksum())
+		time.Sleep(30 * time.Millisecond)
+
+		Convey("Then heartbeats should have been written to the stream", func() {
+			d := NewDecoder(bytes.NewReader(s.Bytes()))
+			So(d.LastFrame().IsZero(), ShouldBeTrue)
+
+			out, err := ioutil.ReadAll(d)
+			So(out, ShouldBeEmpty)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			So(time.Since(d.LastFrame()), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("When data is written between heartbeats", func() {
+			in := randomBytes(CHUNK_SIZE*2 + CHUNK_SIZE/2)
+			e.Write(in[:CHUNK_SIZE])
+			time.Sleep(20 * time.Millisecond)
+			e.Write(in[CHUNK_SIZE:])
+			So(e.Close(), ShouldBeNil)
+
+			Convey("Then the heartbeats should be skipped when decoding", func() {
+				out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(s.Bytes())))
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+
+			Convey("Then no more heartbeats should follow the end", func() {
+				n := len(s.Bytes())
+				time.Sleep(20 * time.Millisecond)
+				So(len(s.Bytes()), ShouldEqual, n)
+			})
+		})
+
+		Reset(func() {
+			e.Close()
+		})
+	})
+}
+
+func TestContext(t *testing.T) {
+	Convey("Given a decoder blocked reading a stream without deadlines", t, func() {
+		r, w := io.Pipe()
+		go func() {
+			e := NewEncoder(w, CHUNK_SIZE)
+			e.Write(randomBytes(CHUNK_SIZE))
+			e.Flush()
+		}()
+		d := NewDecoder(r)
+		So(readN(d, CHUNK_SIZE), ShouldBeNil)
+
+		Convey("When the read's context is canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+			_, err := d.ReadContext(ctx, make([]byte, 1))
+
+			Convey("Then the read should return the context's error", func() {
+				So(err, ShouldEqual, context.Canceled)
+			})
+
+			Convey("Then the stream should be closed", func() {
+				_, err := w.Write([]byte{0})
+				So(err, ShouldEqual, io.ErrClosedPipe)
+			})
+
+			Convey("Then later reads should fail too", func() {
+				_, err := d.Read(make([]byte, 1))
+				So(err, ShouldEqual, context.Canceled)
+			})
+		})
+	})
+
+	Convey("Given a decoder blocked reading a connection", t, func() {
+		c1, c2 := net.Pipe()
+		d := NewDecoder(c1)
+
+		Convey("When the read's deadline passes", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := d.ReadContext(ctx, make([]byte, 1))
+
+			Convey("Then the read should return the context's error", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+			})
+
+			Convey("Then the connection should still be usable", func() {
+				go c2.Write([]byte("ok"))
+				b := make([]byte, 2)
+				_, err := io.ReadFull(c1, b)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "ok")
+			})
+		})
+
+		Reset(func() {
+			c1.Close()
+			c2.Close()
+		})
+	})
+
+	Convey("Given a decoder with a context", t, func() {
+		in := randomBytes(CHUNK_SIZE*2 + CHUNK_SIZE/2)
+		ctx, cancel := context.WithCancel(context.Background())
+		r, w := io.Pipe()
+		d := NewDecoderContext(ctx, r, WithConcurrency(4))
+		e := NewEncoder(w, CHUNK_SIZE, WithCompression(Flate))
+
+		Convey("When the context is canceled while reading ahead", func() {
+			go func() {
+				e.Write(in[:CHUNK_SIZE])
+				e.Flush()
+			}()
+			So(readN(d, CHUNK_SIZE), ShouldBeNil)
+			cancel()
+
+			Convey("Then reads should return the context's error", func() {
+				_, err := d.Read(make([]byte, 1))
+				So(err, ShouldEqual, context.Canceled)
+			})
+
+			Convey("Then the stream should be closed", func() {
+				time.Sleep(10 * time.Millisecond)
+				_, err := w.Write([]byte{0})
+				So(err, ShouldEqual, io.ErrClosedPipe)
+			})
+		})
+
+		Convey("When the stream is read to the end", func() {
+			go func() {
+				e.Write(in)
+				e.Close()
+				w.Write([]byte("more"))
+			}()
+			out, err := ioutil.ReadAll(d)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+
+			Convey("Then canceling the context should leave the stream be", func() {
+				cancel()
+				b := make([]byte, 4)
+				_, err := io.ReadFull(r, b)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "more")
+			})
+		})
+
+		Reset(cancel)
+	})
+}
+
+// readN decoded bytes, failing unless all of them can be read
+func readN(r io.Reader, n int) error {
+	_, err := io.ReadFull(r, make([]byte, n))
+	return err
+}
+
+func TestHeader(t *testing.T) {
+	Convey("Given a stream encoded without checksums", t, func() {
+		in := randomBytes(CHUNK_SIZE * 2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("A decoder requiring checksums should refuse it", func() {
+			_, err := NewDecoder(&s, WithChecksum()).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNoChecksum)
+		})
+
+		Convey("A newer format version should be rejected", func() {
+			s.Bytes()[len(magic)] = version + 1
+			_, err := NewDecoder(&s).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrVersion)
+		})
+
+		Convey("Unknown feature flags should be rejected", func() {
+			s.Bytes()[len(magic)+1] = 0x80
+			_, err := NewDecoder(&s).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrIncompatible)
+		})
+	})
+
+	Convey("Given a stream in the version 2 format", t, func() {
+		in := randomBytes(CHUNK_SIZE*2 + CHUNK_SIZE/2)
+		opts := []Option{WithChecksum(), WithAEAD(newAEAD(testKey)), WithCompression(Flate)}
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, opts...)
+		e.fw.header.version = 2
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("It should be larger than the same stream in the current format", func() {
+			var c bytes.Buffer
+			e := NewEncoder(&c, CHUNK_SIZE, opts...)
+			e.Write(in)
+			So(e.Close(), ShouldBeNil)
+			So(c.Len(), ShouldBeLessThan, s.Len())
+		})
+
+		Convey("It should still be decoded", func() {
+			out, err := ioutil.ReadAll(NewDecoder(&s, opts...))
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+		})
+	})
+
+	Convey("Given input which isn't an encoded stream", t, func() {
+		d := NewDecoder(bytes.NewReader(randomBytes(CHUNK_SIZE)))
+
+		Convey("The decoder should say so, every time it's read", func() {
+			_, err := d.Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNotStream)
+			_, err = d.Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNotStream)
+		})
+	})
+}
+
+func TestLimits(t *testing.T) {
+	Convey("Given a stream with chunks larger than a decoder accepts", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE))
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then the decoder should refuse it", func() {
+			_, err := NewDecoder(&s, WithMaxChunkSize(CHUNK_SIZE/2)).Read(make([]byte, 1))
+			So(err, ShouldResemble, &ChunkSizeError{Size: CHUNK_SIZE, Max: CHUNK_SIZE / 2})
+		})
+	})
+
+	Convey("Given a header claiming huge chunks", t, func() {
+		h := newHeader(1<<30, config{}).bytes()
+
+		Convey("Then a decoder should refuse it by default", func() {
+			_, err := NewDecoder(bytes.NewReader(h)).Read(make([]byte, 1))
+			So(err, ShouldResemble, &ChunkSizeError{Size: 1 << 30, Max: DefaultMaxChunkSize})
+		})
+	})
+
+	Convey("Given headers making a decoder hold more chunks than it allows", t, func() {
+		_, key, _ := ed25519.GenerateKey(nil)
+		headers := map[string][]byte{
+			"deduplicated": newHeader(CHUNK_SIZE, config{dedup: 1<<32 - 1}).bytes(),
+			"signed":       newHeader(CHUNK_SIZE, config{privateKey: key, signEvery: 1<<32 - 1}).bytes(),
+		}
+
+		Convey("Then a decoder should refuse them", func() {
+			for _, h := range headers {
+				_, err := NewDecoder(bytes.NewReader(h), WithMaxChunkSize(CHUNK_SIZE)).Read(make([]byte, 1))
+				So(err, ShouldEqual, ErrMemoryLimit)
+			}
+		})
+	})
+
+	Convey("Given a frame claiming a huge payload, cut short", t, func() {
+		enc := newHeader(DefaultMaxChunkSize, config{}).bytes()
+		enc = append(enc, byte(FrameData), 0)
+		enc = binary.AppendUvarint(enc, DefaultMaxChunkSize)
+		enc = append(enc, randomBytes(CHUNK_SIZE)...)
+
+		Convey("Then decoding it shouldn't allocate the payload", func() {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := NewDecoder(bytes.NewReader(enc)).Read(make([]byte, 1))
+			runtime.ReadMemStats(&after)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			So(after.TotalAlloc-before.TotalAlloc, ShouldBeLessThan, DefaultMaxChunkSize/16)
+		})
+	})
+
+	Convey("Given an encoder of chunks larger than it accepts", t, func() {
+		e := NewEncoder(ioutil.Discard, CHUNK_SIZE, WithMaxChunkSize(CHUNK_SIZE/2))
+
+		Convey("Then it should refuse writes", func() {
+			_, err := e.Write([]byte{1})
+			So(err, ShouldResemble, &ChunkSizeError{Size: CHUNK_SIZE, Max: CHUNK_SIZE / 2})
+		})
 	})
+
+	Convey("Given encoders with chunk sizes which aren't positive", t, func() {
+		Convey("Then they should refuse writes", func() {
+			for _, size := range []int{0, -1} {
+				_, err := NewEncoder(ioutil.Discard, size).Write([]byte{1})
+				So(err, ShouldEqual, ErrInvalidSize)
+			}
+		})
+
+		Convey("Then they should refuse to read from a source", func() {
+			for _, size := range []int{0, -1} {
+				_, err := NewEncoder(ioutil.Discard, size).ReadFrom(bytes.NewReader([]byte{1}))
+				So(err, ShouldEqual, ErrInvalidSize)
+			}
+		})
+	})
+
+	Convey("Given an encoder with a chunk size far above the maximum", t, func() {
+		e := NewEncoder(ioutil.Discard, 1<<36)
+
+		Convey("Then it should refuse to read from a source, without allocating a chunk", func() {
+			_, err := e.ReadFrom(bytes.NewReader([]byte{1}))
+			So(err, ShouldResemble, &ChunkSizeError{Size: 1 << 36, Max: DefaultMaxChunkSize})
+		})
+	})
+
+	Convey("Given an encoder with a deduplication cache larger than decoders allow", t, func() {
+		e := NewEncoder(ioutil.Discard, CHUNK_SIZE, WithMaxChunkSize(CHUNK_SIZE), WithDeduplication(CHUNK_SIZE*maxHeldChunks+1))
+
+		Convey("Then it should refuse writes", func() {
+			_, err := e.Write([]byte{1})
+			So(err, ShouldEqual, ErrMemoryLimit)
+		})
+	})
+}
+
+func TestShortReads(t *testing.T) {
+	Convey("Given a stream with every kind of frame", t, func() {
+		in := randomBytes(CHUNK_SIZE*5 + CHUNK_SIZE/2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithChecksum(), WithCompression(Flate), WithTrailer(), WithSequence(), WithParity(2))
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		readers := map[string]func(io.Reader) io.Reader{
+			"a byte at a time":         iotest.OneByteReader,
+			"half of each read":        iotest.HalfReader,
+			"io.EOF along with data":   iotest.DataErrReader,
+			"a byte at a time, to EOF": func(r io.Reader) io.Reader { return iotest.DataErrReader(iotest.OneByteReader(r)) },
+		}
+		for name, reader := range readers {
+			Convey("Then it should decode when read "+name, func() {
+				out, err := ioutil.ReadAll(NewDecoder(reader(bytes.NewReader(s.Bytes()))))
+				So(err, ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+		}
+	})
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"checksums", []Option{WithChecksum()}},
+		{"sealed", []Option{WithAEAD(newAEAD(testKey)), WithChecksum()}},
+	}
+
+	chunk := randomBytes(CHUNK_SIZE)
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			e := NewEncoder(ioutil.Discard, CHUNK_SIZE, bm.opts...)
+			b.SetBytes(CHUNK_SIZE)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := e.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(bm.name+" unaligned", func(b *testing.B) {
+			e := NewEncoder(ioutil.Discard, CHUNK_SIZE, bm.opts...)
+			b.SetBytes(CHUNK_SIZE)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				e.Write(chunk[:CHUNK_SIZE/3])
+				if _, err := e.Write(chunk[CHUNK_SIZE/3:]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"checksums", []Option{WithChecksum()}},
+		{"sealed", []Option{WithAEAD(newAEAD(testKey)), WithChecksum()}},
+	}
+
+	chunk := randomBytes(CHUNK_SIZE)
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			// Each iteration decodes one chunk of a long stream, so the
+			// allocations of each Decoder are spread over its chunks
+			const chunks = 1000
+			var s bytes.Buffer
+			e := NewEncoder(&s, CHUNK_SIZE, bm.opts...)
+			for i := 0; i < chunks; i++ {
+				e.Write(chunk)
+			}
+			e.Close()
+
+			b.SetBytes(CHUNK_SIZE)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i += chunks {
+				d := NewDecoder(bytes.NewReader(s.Bytes()), bm.opts...)
+				if _, err := d.WriteTo(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrency(b *testing.B) {
+	const size = 64 << 10
+	in := bytes.Repeat(randomBytes(size/16), 16*32)
+	for i := 0; i < len(in); i += 7 {
+		in[i] = byte(i)
+	}
+
+	var s bytes.Buffer
+	e := NewEncoder(&s, size, WithCompression(Flate))
+	e.Write(in)
+	e.Close()
+
+	// Throughput should scale up to the number of cores
+	ns := []int{1}
+	for n := 2; n < runtime.GOMAXPROCS(0); n *= 2 {
+		ns = append(ns, n)
+	}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		ns = append(ns, n)
+	}
+
+	for _, n := range ns {
+		b.Run(fmt.Sprintf("encode %d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				e := NewEncoder(ioutil.Discard, size, WithCompression(Flate), WithConcurrency(n))
+				e.Write(in)
+				if err := e.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("decode %d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				d := NewDecoder(bytes.NewReader(s.Bytes()), WithConcurrency(n))
+				if _, err := d.WriteTo(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// settledGoroutines is the number of goroutines, once those of earlier
+// tests which are about to exit have exited
+func settledGoroutines() int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		m := runtime.NumGoroutine()
+		if m == n {
+			break
+		}
+		n = m
+	}
+	return n
+}
+
+// goroutinesExit waits for the number of goroutines to drop back to n,
+// returning false if it doesn't within a second
+func goroutinesExit(n int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// frameHeaderLen is the encoded length of a compact frame header, without
+// a channel, for a payload of the given length
+func frameHeaderLen(sz int) int {
+	var b [binary.MaxVarintLen64]byte
+	return 2 + binary.PutUvarint(b[:], uint64(sz))
+}
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
 }
 
 func randomBytes(n int) []byte {
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrNoTrailer       = errors.New("stream has no trailer")
+	ErrTrailerMismatch = errors.New("stream doesn't match its trailer")
+	ErrTrailerTooLarge = errors.New("trailer exceeds the stream's payload limit")
+)
+
+// Trailer describes a whole stream, and follows its last chunk. Much like
+// HTTP trailers, it carries what is only known once all data is written.
+type Trailer struct {
+	Length int64             // decoded length of the stream
+	SHA256 [sha256.Size]byte // digest of the decoded stream
+	Fields map[string]string // metadata supplied by the producer
+}
+
+// len is the encoded length of the trailer
+func (t *Trailer) len() int {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(t.Length)) + len(t.SHA256)
+	for k, v := range t.Fields {
+		n += binary.PutUvarint(b[:], uint64(len(k))) + len(k)
+		n += binary.PutUvarint(b[:], uint64(len(v))) + len(v)
+	}
+	return n
+}
+
+// appendTo the given payload as the length, the digest and then each field
+// as a length-prefixed key and value, sorted by key
+func (t *Trailer) appendTo(b []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(t.Length))
+	b = append(b, t.SHA256[:]...)
+
+	keys := make([]string, 0, len(t.Fields))
+	for k := range t.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(t.Fields[k])))
+		b = append(b, t.Fields[k]...)
+	}
+	return b
+}
+
+// parseTrailer from the payload of a trailer frame
+func parseTrailer(p []byte) (*Trailer, bool) {
+	length, n := binary.Uvarint(p)
+	if n <= 0 || len(p[n:]) < sha256.Size {
+		return nil, false
+	}
+	t := &Trailer{Length: int64(length), Fields: make(map[string]string)}
+	p = p[n+copy(t.SHA256[:], p[n:]):]
+
+	field := func() (string, bool) {
+		sz, n := binary.Uvarint(p)
+		if n <= 0 || uint64(len(p[n:])) < sz {
+			return "", false
+		}
+		s := string(p[n : n+int(sz)])
+		p = p[n+int(sz):]
+		return s, true
+	}
+	for len(p) > 0 {
+		k, ok := field()
+		if !ok {
+			return nil, false
+		}
+		if t.Fields[k], ok = field(); !ok {
+			return nil, false
+		}
+	}
+	return t, true
+}
@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTrailer(t *testing.T) {
+	Convey("Given a stream encoded with a trailer and some fields", t, func() {
+		in := randomBytes(CHUNK_SIZE*5 + CHUNK_SIZE/4)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithTrailer(), WithChecksum())
+		e.Write(in)
+		So(e.SetTrailer("producer", "test"), ShouldBeNil)
+		So(e.SetTrailer("content-type", "application/octet-stream"), ShouldBeNil)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then the trailer should be available once the stream is read out", func() {
+			d := NewDecoder(&s, WithTrailer())
+			So(d.Trailer(), ShouldBeNil)
+
+			out, err := ioutil.ReadAll(d)
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, in)
+
+			tr := d.Trailer()
+			So(tr, ShouldNotBeNil)
+			So(tr.Length, ShouldEqual, len(in))
+			So(tr.SHA256, ShouldEqual, sha256.Sum256(in))
+			So(tr.Fields, ShouldResemble, map[string]string{
+				"producer":     "test",
+				"content-type": "application/octet-stream",
+			})
+		})
+
+		Convey("Then fields too large for a chunk should be refused", func() {
+			var s bytes.Buffer
+			e := NewEncoder(&s, CHUNK_SIZE, WithTrailer())
+			err := e.SetTrailer("big", strings.Repeat("x", CHUNK_SIZE))
+			So(err, ShouldEqual, ErrTrailerTooLarge)
+		})
+	})
+
+	Convey("Given a stream whose trailer doesn't match its data", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithTrailer())
+		e.Write(randomBytes(CHUNK_SIZE * 2))
+		e.trailer.Length++
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then decoding should fail at the end", func() {
+			d := NewDecoder(&s)
+			_, err := io.Copy(ioutil.Discard, d)
+			So(err, ShouldEqual, ErrTrailerMismatch)
+			So(d.Trailer(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a stream with its trailer repeated", t, func() {
+		in := randomBytes(CHUNK_SIZE * 2)
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE, WithTrailer())
+		e.Write(in)
+		So(e.Close(), ShouldBeNil)
+
+		enc := s.Bytes()
+		start := headerSize + 2*(frameHeaderLen(CHUNK_SIZE)+CHUNK_SIZE)
+		end := len(enc) - frameHeaderLen(0)
+		enc = append(enc[:end:end], enc[start:]...)
+
+		Convey("Then the decoder should find the second one corrupt", func() {
+			out, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(enc)))
+			So(out, ShouldResemble, in)
+			So(err, ShouldResemble, &CorruptionError{Frame: 3, Chunk: 2, Offset: int64(end)})
+		})
+	})
+
+	Convey("Given a stream without a trailer", t, func() {
+		var s bytes.Buffer
+		e := NewEncoder(&s, CHUNK_SIZE)
+		e.Write(randomBytes(CHUNK_SIZE))
+		So(e.SetTrailer("producer", "test"), ShouldEqual, ErrNoTrailer)
+		So(e.Close(), ShouldBeNil)
+
+		Convey("Then a Decoder requiring one should refuse it", func() {
+			_, err := NewDecoder(&s, WithTrailer()).Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrNoTrailer)
+		})
+	})
+}